@@ -0,0 +1,74 @@
+package httpupgrade
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/tls"
+)
+
+// redactedHeaderWords mark header names whose values DescribeDial hides.
+var redactedHeaderWords = []string{"auth", "cookie", "token", "secret", "password", "key"}
+
+// DescribeDial returns what a dial to dest with streamSettings would send,
+// without connecting: the request exactly as written, with the values of
+// credential-like headers redacted, followed by a summary of the TLS
+// settings and the early-data mode. It is meant for support cases.
+func DescribeDial(dest net.Destination, streamSettings *internet.MemoryStreamConfig) string {
+	transportConfiguration := streamSettings.ProtocolSettings.(*Config)
+	config := tls.ConfigFromStreamSettings(streamSettings)
+	scheme := schemeFor(streamSettings)
+
+	var b bytes.Buffer
+	r, err := buildRequest(scheme, dest.NetAddr(), transportConfiguration)
+	if err != nil {
+		b.WriteString("request: " + err.Error() + "\n")
+		return b.String()
+	}
+	header := make(orderedHeader, 0, len(r.header))
+	for _, f := range r.header {
+		if redactHeader(f.Key) {
+			f.Value = "[redacted]"
+		}
+		header = append(header, f)
+	}
+	if err := writeRequest(&b, r.req.Method, r.target, r.host, header); err != nil {
+		b.WriteString("request: " + err.Error() + "\n")
+	}
+
+	if config == nil {
+		b.WriteString("tls: none\n")
+	} else {
+		tlsConfig := config.GetTLSConfig(tls.WithDestination(dest), tls.WithNextProto("http/1.1"))
+		b.WriteString("tls: sni=" + tlsConfig.ServerName + " alpn=http/1.1")
+		if tls.GetFingerprint(config.Fingerprint) != nil {
+			b.WriteString(" fingerprint=" + config.Fingerprint)
+		} else {
+			b.WriteString(" fingerprint=none")
+		}
+		if tlsConfig.InsecureSkipVerify {
+			b.WriteString(" insecure")
+		}
+		b.WriteString("\n")
+	}
+
+	if r.ed == 0 {
+		b.WriteString("early data: off, the dial waits for the 101\n")
+	} else {
+		b.WriteString("early data: " + strconv.FormatUint(uint64(r.ed), 10) + ", the 101 is read on the first Read\n")
+	}
+	return b.String()
+}
+
+func redactHeader(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range redactedHeaderWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
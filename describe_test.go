@@ -0,0 +1,91 @@
+package httpupgrade
+
+import (
+	"bufio"
+	"context"
+	gonet "net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+)
+
+// captureRequest accepts one connection on a new listener, records the raw
+// request head it receives and accepts the upgrade. It returns the
+// destination to dial and the captured bytes.
+func captureRequest(t *testing.T) (net.Destination, <-chan string) {
+	t.Helper()
+	l, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	captured := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		var head strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			head.WriteString(line)
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		captured <- head.String()
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: upgrade\r\n\r\n"))
+	}()
+	addr := l.Addr().(*gonet.TCPAddr)
+	return net.TCPDestination(net.IPAddress(addr.IP), net.Port(addr.Port)), captured
+}
+
+func TestDescribeDialMatchesDial(t *testing.T) {
+	dest, captured := captureRequest(t)
+	streamSettings := &internet.MemoryStreamConfig{ProtocolSettings: &Config{
+		Host: "cdn.example.com",
+		Path: "/tunnel?b=1&ed=2048",
+		Header: map[string]string{
+			"user-agent":      "Mozilla/5.0",
+			"X-Forwarded-For": "1.1.1.1",
+			"Authorization":   "Bearer hunter2",
+			"X-Api-Key":       "k3y",
+		},
+	}}
+	description := DescribeDial(dest, streamSettings)
+
+	conn, err := Dial(context.Background(), dest, streamSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// early data defers everything until the first write
+	conn.Write(nil)
+	sent := <-captured
+
+	request, summary, found := strings.Cut(description, "\r\n\r\n")
+	if !found {
+		t.Fatalf("no request in %q", description)
+	}
+	redacted := strings.NewReplacer("Bearer hunter2", "[redacted]", "k3y", "[redacted]").Replace(sent)
+	if request+"\r\n\r\n" != redacted {
+		t.Errorf("described\n%q\nsent (redacted)\n%q", request+"\r\n\r\n", redacted)
+	}
+	for _, secret := range []string{"hunter2", "k3y"} {
+		if strings.Contains(description, secret) {
+			t.Errorf("description leaks %q", secret)
+		}
+	}
+	if !strings.Contains(sent, "Authorization: Bearer hunter2\r\n") {
+		t.Errorf("the dial redacted what it sent: %q", sent)
+	}
+	if want := "tls: none\nearly data: 2048, the 101 is read on the first Read\n"; summary != want {
+		t.Errorf("summary %q, want %q", summary, want)
+	}
+}
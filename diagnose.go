@@ -0,0 +1,102 @@
+package httpupgrade
+
+import (
+	"context"
+	gotls "crypto/tls"
+	gonet "net"
+	"net/http"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+)
+
+// StageDNS is the name resolution Diagnose performs ahead of connecting.
+const StageDNS Stage = "dns"
+
+// DiagnoseReport describes what each stage of a diagnostic dial took and
+// revealed. Fields of stages that were not reached are left zero.
+type DiagnoseReport struct {
+	ProbeResult
+	DNS time.Duration
+	// Addresses are what the destination's domain resolved to through the
+	// resolver set by ContextWithResolver, or the system resolver. The
+	// diagnostic dial connects to the first of them.
+	Addresses []net.IP
+
+	TLSVersion string
+	ALPN       string
+	Resumed    bool
+	// Certificates summarizes the peer's chain, leaf first. Version, Resumed
+	// and Certificates are only known for the standard TLS client, not for
+	// uTLS fingerprints.
+	Certificates []string
+
+	// Status and ResponseHeader are the server's answer to the upgrade
+	// request, whether it was accepted or not.
+	Status         string
+	ResponseHeader http.Header
+}
+
+// Diagnose checks whether streamSettings can reach dest: it resolves the
+// destination, connects, completes TLS and the upgrade handshake, and closes
+// the connection without sending any payload. On failure the report names the
+// failed stage and holds whatever was learned up to there, including the
+// server's response if it rejected the upgrade.
+func Diagnose(ctx context.Context, streamSettings *internet.MemoryStreamConfig, dest net.Destination) (*DiagnoseReport, error) {
+	report := new(DiagnoseReport)
+	connectTo := dest
+	if dest.Address.Family().IsDomain() {
+		tracer := tracerFromContext(ctx)
+		tracer.dnsStart(dest.Address.Domain())
+		start := time.Now()
+		var addrs []net.IP
+		var err error
+		if resolver := resolverFromContext(ctx); resolver != nil {
+			addrs, err = resolver.LookupIP(ctx, dest.Address.Domain())
+		} else {
+			addrs, err = gonet.DefaultResolver.LookupIP(ctx, "ip", dest.Address.Domain())
+		}
+		report.DNS = time.Since(start)
+		tracer.dnsDone(addrs, err)
+		if err == nil && len(addrs) == 0 {
+			err = errors.New("no address for ", dest.Address)
+		}
+		if err != nil {
+			report.Failed = StageDNS
+			info := newDialInfo(dest, schemeFor(streamSettings), streamSettings.ProtocolSettings.(*Config))
+			return report, info.wrap(StageDNS, err)
+		}
+		report.Addresses = addrs
+		// connect to what was reported instead of resolving again
+		connectTo.Address = net.IPAddress(addrs[0])
+	} else {
+		report.Addresses = []net.IP{dest.Address.IP()}
+	}
+	return report, probe(ctx, streamSettings, dest, connectTo, report)
+}
+
+// recordTLS fills in what conn reveals about its TLS session, if it has one.
+func (r *DiagnoseReport) recordTLS(conn net.Conn) {
+	if c, ok := conn.(interface {
+		NegotiatedProtocol() (string, bool)
+	}); ok {
+		r.ALPN, _ = c.NegotiatedProtocol()
+	}
+	c, ok := conn.(interface {
+		ConnectionState() gotls.ConnectionState
+	})
+	if !ok {
+		return
+	}
+	state := c.ConnectionState()
+	r.TLSVersion = gotls.VersionName(state.Version)
+	r.ALPN = state.NegotiatedProtocol
+	r.Resumed = state.DidResume
+	for _, cert := range state.PeerCertificates {
+		r.Certificates = append(r.Certificates, cert.Subject.CommonName+
+			" (issued by "+cert.Issuer.CommonName+
+			", expires "+cert.NotAfter.Format(time.DateOnly)+")")
+	}
+}
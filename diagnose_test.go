@@ -0,0 +1,121 @@
+package httpupgrade
+
+import (
+	"context"
+	goerrors "errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/httpupgrade/httpupgradetest"
+	"github.com/xtls/xray-core/transport/internet/tls"
+)
+
+// countingResolver answers every lookup with ips and counts the lookups.
+type countingResolver struct {
+	ips     []net.IP
+	err     error
+	lookups atomic.Int32
+}
+
+func (r *countingResolver) LookupIP(ctx context.Context, domain string) ([]net.IP, error) {
+	r.lookups.Add(1)
+	return r.ips, r.err
+}
+
+func TestDiagnoseResolvesOnce(t *testing.T) {
+	s, err := httpupgradetest.NewFaultyServer(httpupgradetest.Upgrade())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.Addr().(*net.TCPAddr)
+
+	resolver := &countingResolver{ips: []net.IP{addr.IP}}
+	ctx := ContextWithResolver(context.Background(), resolver)
+	dest := net.TCPDestination(net.DomainAddress("example.com"), net.Port(addr.Port))
+	streamSettings := &internet.MemoryStreamConfig{ProtocolSettings: &Config{}}
+	report, err := Diagnose(ctx, streamSettings, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := resolver.lookups.Load(); n != 1 {
+		t.Errorf("resolved %d times, want once", n)
+	}
+	if len(report.Addresses) != 1 || !report.Addresses[0].Equal(addr.IP) {
+		t.Errorf("addresses %v, want %v", report.Addresses, addr.IP)
+	}
+	if report.Status != "101 Switching Protocols" {
+		t.Errorf("status %q", report.Status)
+	}
+}
+
+func TestDiagnoseDNSFailure(t *testing.T) {
+	for _, resolver := range []*countingResolver{
+		{err: goerrors.New("no such host")},
+		{},
+	} {
+		ctx := ContextWithResolver(context.Background(), resolver)
+		dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+		streamSettings := &internet.MemoryStreamConfig{ProtocolSettings: &Config{Host: "cdn.example.com"}}
+		report, err := Diagnose(ctx, streamSettings, dest)
+		var handshakeErr *HandshakeError
+		if !goerrors.As(err, &handshakeErr) || handshakeErr.Stage != StageDNS || handshakeErr.Host != "cdn.example.com" {
+			t.Errorf("error %v, want a HandshakeError at the DNS stage", err)
+		}
+		if report.Failed != StageDNS {
+			t.Errorf("failed stage %q", report.Failed)
+		}
+	}
+}
+
+func TestDiagnoseHonorsContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	streamSettings := &internet.MemoryStreamConfig{ProtocolSettings: &Config{}}
+	report, err := Diagnose(ctx, streamSettings, dest)
+	if !goerrors.Is(err, context.Canceled) || report.Failed != StageDNS {
+		t.Errorf("failed at %q: %v, want the DNS lookup canceled", report.Failed, err)
+	}
+}
+
+// diagnoseFaulty diagnoses a FaultyServer running steps.
+func diagnoseFaulty(t *testing.T, streamSettings *internet.MemoryStreamConfig, steps ...httpupgradetest.Step) (*DiagnoseReport, error) {
+	t.Helper()
+	s, err := httpupgradetest.NewFaultyServer(steps...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	addr := s.Addr().(*net.TCPAddr)
+	dest := net.TCPDestination(net.IPAddress(addr.IP), net.Port(addr.Port))
+	return Diagnose(context.Background(), streamSettings, dest)
+}
+
+func TestDiagnoseTLSFailure(t *testing.T) {
+	streamSettings := &internet.MemoryStreamConfig{
+		ProtocolSettings: &Config{},
+		SecuritySettings: &tls.Config{AllowInsecure: true},
+	}
+	report, err := diagnoseFaulty(t, streamSettings, httpupgradetest.Upgrade())
+	requireStage(t, err, StageTLS, "plaintext")
+	if report.Failed != StageTLS || report.TLSVersion != "" || report.Status != "" {
+		t.Errorf("report %+v", report)
+	}
+}
+
+func TestDiagnoseRejectedUpgrade(t *testing.T) {
+	header := http.Header{"Server": {"cdn"}, "Content-Length": {"6"}}
+	streamSettings := &internet.MemoryStreamConfig{ProtocolSettings: &Config{}}
+	report, err := diagnoseFaulty(t, streamSettings, httpupgradetest.Respond(http.StatusForbidden, header, "denied"))
+	requireStage(t, err, StageValidate, "403")
+	if report.Failed != StageValidate {
+		t.Errorf("failed at %q", report.Failed)
+	}
+	if report.Status != "403 Forbidden" || report.ResponseHeader.Get("Server") != "cdn" {
+		t.Errorf("status %q, header %v", report.Status, report.ResponseHeader)
+	}
+}
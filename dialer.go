@@ -3,9 +3,16 @@ package httpupgrade
 import (
 	"bufio"
 	"context"
+	gotls "crypto/tls"
+	goerrors "errors"
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/common/errors"
@@ -15,73 +22,385 @@ import (
 	"github.com/xtls/xray-core/transport/internet/tls"
 )
 
+const (
+	// maxResponseHeaderBytes bounds how much the handshake reads from the
+	// server before the response headers must be complete.
+	maxResponseHeaderBytes = 16 << 10
+	// maxResponseHeaderCount bounds the number of response header fields.
+	maxResponseHeaderCount = 100
+	// maxRequestLineBytes bounds the request line, which proxies commonly
+	// limit to about 8 KB and answer a silent 414 beyond.
+	maxRequestLineBytes = 8 << 10
+	// maxPeekBytes bounds how much Peek may buffer ahead of the reader.
+	maxPeekBytes = 64 << 10
+)
+
+var (
+	// ErrResponseHeaderTooLarge is returned when the server's response headers
+	// exceed maxResponseHeaderBytes or maxResponseHeaderCount.
+	ErrResponseHeaderTooLarge = errors.New("response headers too large")
+	// ErrUnrequestedExtension is returned when the server negotiates a
+	// WebSocket extension, which the raw tunneled stream can't honor.
+	ErrUnrequestedExtension = errors.New("server negotiated an unrequested extension")
+	// ErrPeekAfterRead is returned by Peek once reads go to the underlying
+	// conn directly.
+	ErrPeekAfterRead = errors.New("Peek called after reads went to the underlying conn")
+	// ErrUDPDestination is returned when asked to dial a UDP destination,
+	// usually a routing mistake, since the transport only carries streams.
+	ErrUDPDestination = errors.New("httpupgrade cannot carry a UDP destination, check the routing to this outbound")
+)
+
+// Flusher is implemented by layers stacked on a ConnRF that buffer outgoing
+// data, so that Close can push it out before the underlying conn goes away.
+type Flusher interface {
+	Flush() error
+}
+
 type ConnRF struct {
 	net.Conn
 	Req   *http.Request
 	First bool
+	// Flushers are flushed in order by Close before the conn is closed.
+	Flushers []Flusher
+
+	// resp is the server's response once the handshake has read it.
+	resp *http.Response
+	// tracer, if set, is told about the response.
+	tracer *Tracer
+	// info, if set, is what handshake errors are attributed to.
+	info *dialInfo
+	// leftover holds bytes that arrived behind the response headers and have
+	// not been handed to the caller yet.
+	leftover []byte
+	// mu serializes Read and Peek until reads go direct.
+	mu sync.Mutex
+	// direct is set once reads can go straight to the underlying conn.
+	direct atomic.Bool
+	// takenOver is set by TakeOver on connections handed out by Serve.
+	takenOver atomic.Bool
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func (c *ConnRF) Read(b []byte) (int, error) {
+	if c.direct.Load() {
+		return c.Conn.Read(b)
+	}
+	return c.read(b)
+}
+
+// read is the slow path of Read, taken until the handshake is done and the
+// leftover buffer is drained.
+func (c *ConnRF) read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.First {
-		c.First = false
-		// create reader capped to size of `b`, so it can be fully drained into
-		// `b` later with a single Read call
-		reader := bufio.NewReaderSize(c.Conn, len(b))
-		resp, err := http.ReadResponse(reader, c.Req) // nolint:bodyclose
-		if err != nil {
+		if err := c.handshake(); err != nil {
 			return 0, err
 		}
-		if resp.Status != "101 Switching Protocols" ||
-			strings.ToLower(resp.Header.Get("Upgrade")) != "websocket" ||
-			strings.ToLower(resp.Header.Get("Connection")) != "upgrade" {
-			return 0, errors.New("unrecognized reply")
-		}
-		// drain remaining bufreader
-		return reader.Read(b[:reader.Buffered()])
 	}
+	if len(c.leftover) > 0 {
+		n := copy(b, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+	c.direct.Store(true)
 	return c.Conn.Read(b)
 }
 
-func dialhttpUpgrade(ctx context.Context, dest net.Destination, streamSettings *internet.MemoryStreamConfig) (net.Conn, error) {
+// Peek returns the next n bytes without advancing the read position,
+// completing the upgrade handshake first if it is still pending. It blocks
+// until n bytes are buffered or the conn's read deadline expires, in which
+// case the bytes buffered so far are returned along with the error. Like
+// bufio.Reader.Peek, it fails with bufio.ErrNegativeCount for a negative n and
+// with bufio.ErrBufferFull for an n beyond maxPeekBytes (64 KiB).
+// Peek is only available until a Read has drained what was peeked or
+// buffered behind the response and gone to the underlying conn directly;
+// from then on it fails with ErrPeekAfterRead. Until then Peek and Read
+// exclude each other, so bytes are never split between them.
+func (c *ConnRF) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, bufio.ErrNegativeCount
+	}
+	if n > maxPeekBytes {
+		return nil, bufio.ErrBufferFull
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.direct.Load() {
+		return nil, ErrPeekAfterRead
+	}
+	if c.First {
+		if err := c.handshake(); err != nil {
+			return nil, err
+		}
+	}
+	for len(c.leftover) < n {
+		buf := make([]byte, n-len(c.leftover))
+		m, err := c.Conn.Read(buf)
+		c.leftover = append(c.leftover, buf[:m]...)
+		if err != nil {
+			return c.leftover[:len(c.leftover):len(c.leftover)], err
+		}
+	}
+	return c.leftover[:n:n], nil
+}
+
+// handshake reads and validates the upgrade response. Callers must hold c.mu.
+func (c *ConnRF) handshake() (err error) {
+	c.First = false
+	if c.tracer != nil {
+		defer func() {
+			c.tracer.gotResponse(c.resp, err)
+		}()
+	}
+	reader, err := c.readResponse()
+	if err != nil {
+		return c.info.wrap(StageResponse, err)
+	}
+	if err := validateResponse(c.resp); err != nil {
+		return c.info.wrap(StageValidate, err)
+	}
+	if n := reader.Buffered(); n > 0 {
+		c.leftover, _ = reader.Peek(n)
+	}
+	return nil
+}
+
+// readResponse parses the server's response into c.resp and returns the
+// reader holding whatever followed it.
+func (c *ConnRF) readResponse() (*bufio.Reader, error) {
+	// the response may arrive split into any number of segments, or
+	// coalesced with the first tunneled bytes, so parse it independently
+	// of the caller's buffer and keep whatever was read past the headers
+	limited := &io.LimitedReader{R: c.Conn, N: maxResponseHeaderBytes}
+	reader := bufio.NewReader(limited)
+	// a TLS server answers a plaintext request with an alert or handshake
+	// record, which would otherwise fail to parse cryptically below
+	if b, err := reader.Peek(2); err == nil && (b[0] == 0x15 || b[0] == 0x16) && b[1] == 0x03 {
+		return nil, errors.New("httpupgrade: server appears to require TLS")
+	}
+	resp, err := http.ReadResponse(reader, c.Req) // nolint:bodyclose
+	if err != nil {
+		if limited.N == 0 {
+			return nil, ErrResponseHeaderTooLarge
+		}
+		return nil, err
+	}
+	c.resp = resp
+	count := 0
+	for _, values := range resp.Header {
+		count += len(values)
+	}
+	if count > maxResponseHeaderCount {
+		return nil, ErrResponseHeaderTooLarge
+	}
+	return reader, nil
+}
+
+// validateResponse checks that resp accepts the upgrade.
+func validateResponse(resp *http.Response) error {
+	if resp.Status != "101 Switching Protocols" ||
+		strings.ToLower(resp.Header.Get("Upgrade")) != "websocket" ||
+		strings.ToLower(resp.Header.Get("Connection")) != "upgrade" {
+		if snippet := bodySnippet(resp); snippet != "" {
+			return errors.New("unrecognized reply: ", resp.Status, " ", strconv.Quote(snippet))
+		}
+		return errors.New("unrecognized reply: ", resp.Status)
+	}
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		return errors.New("unexpected extension: ", ext).Base(ErrUnrequestedExtension)
+	}
+	// net/http moves Transfer-Encoding out of the header map
+	if len(resp.TransferEncoding) > 0 || resp.Header.Get("Content-Encoding") != "" {
+		return errors.New("101 reply carries a transfer or content coding, the tunneled stream would be corrupted")
+	}
+	return nil
+}
+
+// errorBodySnippetSize bounds how much of a rejection's body is quoted in the
+// handshake error.
+const errorBodySnippetSize = 256
+
+// bodySnippet returns the start of a rejection's body for error messages.
+// Bodies without framing are skipped, since reading them would block until
+// the server closes the conn.
+func bodySnippet(resp *http.Response) string {
+	if resp.ContentLength <= 0 && len(resp.TransferEncoding) == 0 {
+		return ""
+	}
+	// resp.Body undoes any chunked transfer coding
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, errorBodySnippetSize))
+	return strings.TrimSpace(string(b))
+}
+
+// Close flushes every registered Flusher and then closes the underlying conn.
+// It is safe to call more than once; later calls return the first result.
+func (c *ConnRF) Close() error {
+	c.closeOnce.Do(func() {
+		errs := make([]error, 0, len(c.Flushers)+1)
+		for _, f := range c.Flushers {
+			errs = append(errs, f.Flush())
+		}
+		errs = append(errs, c.Conn.Close())
+		c.closeErr = errors.Combine(errs...)
+	})
+	return c.closeErr
+}
+
+func dialhttpUpgrade(ctx context.Context, dest net.Destination, streamSettings *internet.MemoryStreamConfig) (_ net.Conn, err error) {
 	transportConfiguration := streamSettings.ProtocolSettings.(*Config)
+	info := newDialInfo(dest, schemeFor(streamSettings), transportConfiguration)
+	if dest.Network == net.Network_UDP {
+		return nil, info.wrap(StageConnect, ErrUDPDestination)
+	}
 
-	pconn, err := internet.DialSystem(ctx, dest, streamSettings.SocketSettings)
+	pconn, err := dialSystem(ctx, dest, streamSettings.SocketSettings)
 	if err != nil {
 		errors.LogErrorInner(ctx, err, "failed to dial to ", dest)
+		return nil, info.wrap(StageConnect, err)
+	}
+	defer closeOnError(pconn, &err)
+
+	conn, scheme, err := clientTLS(ctx, pconn, streamSettings, info)
+	if err != nil {
 		return nil, err
 	}
 
+	return upgrade(ctx, conn, scheme, transportConfiguration, info)
+}
+
+// closeOnError closes c if *err is set by the time the calling function
+// returns, so that failed dials don't leak their socket.
+func closeOnError(c io.Closer, err *error) {
+	if *err != nil {
+		c.Close()
+	}
+}
+
+// handshaker is implemented by the TLS conns this package deals with.
+type handshaker interface {
+	HandshakeContext(context.Context) error
+}
+
+// schemeFor returns the URL scheme of the upgrade request a dial with
+// streamSettings sends.
+func schemeFor(streamSettings *internet.MemoryStreamConfig) string {
+	if tls.ConfigFromStreamSettings(streamSettings) != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// clientTLS wraps pconn in TLS and completes the handshake when
+// streamSettings ask for it, and returns the URL scheme the upgrade request
+// should use. It records the server name used in info.
+func clientTLS(ctx context.Context, pconn net.Conn, streamSettings *internet.MemoryStreamConfig, info *dialInfo) (net.Conn, string, error) {
+	config := tls.ConfigFromStreamSettings(streamSettings)
+	if config == nil {
+		return pconn, "http", nil
+	}
+	tracer := tracerFromContext(ctx)
+	tracer.tlsHandshakeStart()
+	tlsConfig := config.GetTLSConfig(tls.WithDestination(info.dest), tls.WithNextProto("http/1.1"))
+	info.serverName = tlsConfig.ServerName
 	var conn net.Conn
-	var requestURL url.URL
-	if config := tls.ConfigFromStreamSettings(streamSettings); config != nil {
-		tlsConfig := config.GetTLSConfig(tls.WithDestination(dest), tls.WithNextProto("http/1.1"))
-		if fingerprint := tls.GetFingerprint(config.Fingerprint); fingerprint != nil {
-			conn = tls.UClient(pconn, tlsConfig, fingerprint)
-			if err := conn.(*tls.UConn).WebsocketHandshakeContext(ctx); err != nil {
-				return nil, err
-			}
-		} else {
-			conn = tls.Client(pconn, tlsConfig)
-		}
-		requestURL.Scheme = "https"
+	var err error
+	if fingerprint := tls.GetFingerprint(config.Fingerprint); fingerprint != nil {
+		conn = tls.UClient(pconn, tlsConfig, fingerprint)
+		err = conn.(*tls.UConn).WebsocketHandshakeContext(ctx)
 	} else {
-		conn = pconn
-		requestURL.Scheme = "http"
+		conn = tls.Client(pconn, tlsConfig)
+		err = conn.(handshaker).HandshakeContext(ctx)
 	}
+	tracer.tlsHandshakeDone(err)
+	if err != nil {
+		return nil, "", info.wrap(StageTLS, tlsMismatch(err))
+	}
+	return conn, "https", nil
+}
+
+// tlsMismatch explains a TLS handshake error caused by the server answering
+// in plaintext HTTP, and returns any other error unchanged.
+func tlsMismatch(err error) error {
+	var recordErr gotls.RecordHeaderError
+	if goerrors.As(err, &recordErr) && string(recordErr.RecordHeader[:]) == "HTTP/" ||
+		strings.Contains(err.Error(), "first record does not look like a TLS handshake") {
+		return errors.New("httpupgrade: server appears to speak plaintext HTTP, not TLS").Base(err)
+	}
+	return err
+}
+
+// DialWithConn performs only the HTTP upgrade over conn, which the caller has
+// already connected to dest and wrapped in TLS if wanted. It is the second
+// half of Dial, for embedders that manage the lower layers themselves.
+func DialWithConn(ctx context.Context, conn net.Conn, dest net.Destination, config *Config) (net.Conn, error) {
+	scheme := "http"
+	if _, ok := conn.(handshaker); ok {
+		scheme = "https"
+	}
+	info := newDialInfo(dest, scheme, config)
+	if c, ok := conn.(interface {
+		ConnectionState() gotls.ConnectionState
+	}); ok {
+		info.serverName = c.ConnectionState().ServerName
+	}
+	return upgrade(ctx, conn, scheme, config, info)
+}
+
+// mandatoryHeaders are the request headers every upgrade carries.
+var mandatoryHeaders = map[string]string{
+	"Connection": "upgrade",
+	"Upgrade":    "websocket",
+}
 
-	requestURL.Host = dest.NetAddr()
-	requestURL.Path = transportConfiguration.GetNormalizedPath()
+// upgradeRequest is a fully built upgrade request, ready to be written.
+type upgradeRequest struct {
+	// req mirrors what is written and is used to parse the response.
+	req    *http.Request
+	target string
+	host   string
+	header orderedHeader
+	// ed is the effective early-data setting.
+	ed uint32
+}
+
+// buildRequest assembles the upgrade request a dial to addr would send.
+func buildRequest(scheme, addr string, transportConfiguration *Config) (*upgradeRequest, error) {
+	requestURL := url.URL{Scheme: scheme}
+	requestURL.Host = addr
+	var ed uint32
+	requestURL.Path, requestURL.RawQuery, ed = splitPathEd(transportConfiguration.GetNormalizedPath())
+	if transportConfiguration.Ed != 0 {
+		ed = transportConfiguration.Ed
+	}
+	configuredHost, err := normalizeHost(scheme, transportConfiguration.Host)
+	if err != nil {
+		return nil, err
+	}
 	req := &http.Request{
 		Method: http.MethodGet,
 		URL:    &requestURL,
-		Host:   transportConfiguration.Host,
+		Host:   configuredHost,
 		Header: make(http.Header),
 	}
+	// the headers making this an upgrade always win; configuring them to
+	// anything else is a mistake worth reporting rather than overriding.
+	// The stream is never framed or compressed, so offering an extension is
+	// one too.
 	for key, value := range transportConfiguration.Header {
-		req.Header.Add(key, value)
+		if strings.EqualFold(key, "Sec-WebSocket-Extensions") {
+			return nil, errors.New("configured header ", key, ": ", value, " offers an extension the transport cannot carry")
+		}
+		if want, ok := mandatoryHeaders[http.CanonicalHeaderKey(key)]; ok && value != "" && !strings.EqualFold(value, want) {
+			return nil, errors.New("configured header ", key, ": ", value, " conflicts with the upgrade")
+		}
+	}
+	header := headerFromConfig(transportConfiguration.Header)
+	for _, f := range header {
+		AddHeader(req.Header, f.Key, f.Value)
 	}
-	req.Header.Set("Connection", "upgrade")
-	req.Header.Set("Upgrade", "websocket")
 
 	if requestURL.Path == "" {
 		requestURL.Path = "GET"
@@ -98,20 +417,133 @@ func dialhttpUpgrade(ctx context.Context, dest net.Destination, streamSettings *
 		requestURL.Opaque = pathSplited[1] + ":" + pathSplited[2]
 	}
 
-	err = req.Write(conn)
+	target := requestURL.RequestURI()
+	if n := len(req.Method) + len(" ") + len(target) + len(" HTTP/1.1"); n > maxRequestLineBytes {
+		return nil, errors.New("request line of ", n, " bytes exceeds ", maxRequestLineBytes, ", shorten the path")
+	}
+
+	host := req.Host
+	if host == "" {
+		host = requestURL.Host
+	}
+	return &upgradeRequest{
+		req:    req,
+		target: target,
+		host:   host,
+		header: header,
+		ed:     ed,
+	}, nil
+}
+
+// warnedSchemeHosts holds the configured hosts normalizeHost has warned about.
+var warnedSchemeHosts sync.Map
+
+// normalizeHost turns a configured Host into the value to send. A scheme
+// pasted along with it is stripped, a port is kept unless it is the default
+// for that scheme, or for scheme if none was given, and the result is
+// lowercased.
+func normalizeHost(scheme, host string) (string, error) {
+	if host == "" {
+		return "", nil
+	}
+	h := host
+	if i := strings.Index(h, "://"); i >= 0 {
+		switch strings.ToLower(h[:i]) {
+		case "http", "ws":
+			scheme = "http"
+		case "https", "wss":
+			scheme = "https"
+		default:
+			return "", errors.New("invalid host ", strconv.Quote(host), ": unsupported scheme")
+		}
+		// the host is normalized on every dial, so only complain once
+		if _, warned := warnedSchemeHosts.LoadOrStore(host, struct{}{}); !warned {
+			errors.LogWarning(context.Background(), "ignoring the scheme in host ", strconv.Quote(host))
+		}
+		// a trailing slash usually comes along with a pasted URL
+		h = strings.TrimSuffix(h[i+len("://"):], "/")
+	}
+	if h == "" || strings.ContainsAny(h, " \t\r\n/\\") {
+		return "", errors.New("invalid host ", strconv.Quote(host), ": must be a bare host name with an optional port")
+	}
+	defaultPort := "80"
+	if scheme == "https" {
+		defaultPort = "443"
+	}
+	if name, port, err := net.SplitHostPort(h); err == nil && port == defaultPort {
+		if strings.Contains(name, ":") {
+			name = "[" + name + "]"
+		}
+		h = name
+	}
+	return strings.ToLower(h), nil
+}
+
+// splitPathEd splits the query off path and takes the early-data setting out
+// of its "ed" parameter, the way xray's websocket paths carry it. The rest of
+// the query is kept byte for byte; queries without a valid "ed" are returned
+// untouched.
+func splitPathEd(path string) (string, string, uint32) {
+	path, rawQuery, found := strings.Cut(path, "?")
+	if !found {
+		return path, "", 0
+	}
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		key, value, _ := strings.Cut(pair, "=")
+		if key, err := url.QueryUnescape(key); err != nil || key != "ed" {
+			continue
+		}
+		value, err := url.QueryUnescape(value)
+		if err != nil {
+			return path, rawQuery, 0
+		}
+		ed, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return path, rawQuery, 0
+		}
+		pairs = append(pairs[:i], pairs[i+1:]...)
+		return path, strings.Join(pairs, "&"), uint32(ed)
+	}
+	return path, rawQuery, 0
+}
+
+func (r *upgradeRequest) writeTo(w io.Writer) error {
+	return writeRequest(w, r.req.Method, r.target, r.host, r.header)
+}
+
+// upgrade sends the upgrade request over conn and, unless early data is
+// enabled, waits for the server to accept it.
+func upgrade(ctx context.Context, conn net.Conn, scheme string, transportConfiguration *Config, info *dialInfo) (c net.Conn, err error) {
+	release := bindContext(ctx, conn)
+	defer func() {
+		if rerr := release(); rerr != nil {
+			c, err = nil, info.wrap(stageOf(err, StageRequest), rerr)
+		}
+	}()
+
+	r, err := buildRequest(scheme, info.dest.NetAddr(), transportConfiguration)
 	if err != nil {
-		return nil, err
+		return nil, info.wrap(StageRequest, err)
+	}
+	tracer := tracerFromContext(ctx)
+	err = r.writeTo(conn)
+	tracer.wroteRequest(err)
+	if err != nil {
+		// a TLS conn handed to DialWithConn may handshake on this first write
+		return nil, info.wrap(StageRequest, tlsMismatch(err))
 	}
 
 	connRF := &ConnRF{
-		Conn:  conn,
-		Req:   req,
-		First: true,
+		Conn:   conn,
+		Req:    r.req,
+		First:  true,
+		tracer: tracer,
+		info:   info,
 	}
 
-	if transportConfiguration.Ed == 0 {
-		_, err = connRF.Read([]byte{})
-		if err != nil {
+	if r.ed == 0 {
+		if _, err := connRF.Read([]byte{}); err != nil {
 			return nil, err
 		}
 	}
@@ -119,6 +551,30 @@ func dialhttpUpgrade(ctx context.Context, dest net.Destination, streamSettings *
 	return connRF, nil
 }
 
+// bindContext mirrors ctx's deadline and cancellation onto conn, since the
+// standard TLS handshake, the request write and the response read block on
+// conn without observing ctx. The returned func lifts them again, reporting
+// ctx's error if it fired in the meantime.
+func bindContext(ctx context.Context, conn net.Conn) (release func() error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// AfterFunc would only catch up with an already done ctx from another
+	// goroutine, racing the first write
+	if ctx.Err() != nil {
+		conn.SetDeadline(time.Now())
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	return func() error {
+		if !stop() {
+			return ctx.Err()
+		}
+		return conn.SetDeadline(time.Time{})
+	}
+}
+
 // http.Header.Add() will convert headers to MIME header format.
 // Some people don't like this because they want to send "Web*S*ocket".
 // So we add a simple function to replace that method.
@@ -0,0 +1,735 @@
+package httpupgrade
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	gotls "crypto/tls"
+	"crypto/x509"
+	goerrors "errors"
+	"io"
+	gonet "net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/httpupgrade/httpupgradetest"
+	"github.com/xtls/xray-core/transport/internet/tls"
+)
+
+// dialFaulty dials a FaultyServer running steps with config.
+func dialFaulty(t *testing.T, ctx context.Context, config *Config, steps ...httpupgradetest.Step) (net.Conn, error) {
+	t.Helper()
+	s, err := httpupgradetest.NewFaultyServer(steps...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	addr := s.Addr().(*net.TCPAddr)
+	dest := net.TCPDestination(net.IPAddress(addr.IP), net.Port(addr.Port))
+	conn, err := Dial(ctx, dest, &internet.MemoryStreamConfig{ProtocolSettings: config})
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, err
+}
+
+// requireStage fails t unless err is a HandshakeError for stage whose message
+// contains text.
+func requireStage(t *testing.T, err error, stage Stage, text string) {
+	t.Helper()
+	var handshakeErr *HandshakeError
+	if !goerrors.As(err, &handshakeErr) {
+		t.Fatalf("got %v, want a HandshakeError", err)
+	}
+	if handshakeErr.Stage != stage {
+		t.Errorf("failed at %q, want %q: %v", handshakeErr.Stage, stage, err)
+	}
+	if !strings.Contains(handshakeErr.Error(), text) {
+		t.Errorf("error %q does not mention %q", handshakeErr.Error(), text)
+	}
+}
+
+func TestDialUpgrade(t *testing.T) {
+	conn, err := dialFaulty(t, context.Background(), &Config{}, httpupgradetest.Upgrade(), httpupgradetest.Raw([]byte("tunneled")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "tunneled" {
+		t.Errorf("read %q, %v", b, err)
+	}
+}
+
+func TestDialFaultyServer(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		steps []httpupgradetest.Step
+		stage Stage
+		text  string
+	}{
+		{"truncated 101", []httpupgradetest.Step{httpupgradetest.CloseAfterBytes(20), httpupgradetest.Upgrade()}, StageResponse, "EOF"},
+		{"520 page", []httpupgradetest.Step{httpupgradetest.Respond(520, http.Header{"Content-Length": {"21"}}, "origin is unreachable")}, StageValidate, `"origin is unreachable"`},
+		{"garbage", []httpupgradetest.Step{httpupgradetest.Raw([]byte("\x00\x01\x02 \r\n\r\n")), httpupgradetest.Garbage(64)}, StageResponse, "malformed HTTP"},
+		{"closed", nil, StageResponse, "EOF"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := dialFaulty(t, context.Background(), &Config{}, test.steps...)
+			requireStage(t, err, test.stage, test.text)
+		})
+	}
+}
+
+func TestDialSilentServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := dialFaulty(t, ctx, &Config{}, httpupgradetest.Silence())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("returned after %v", elapsed)
+	}
+	requireStage(t, err, StageResponse, "")
+}
+
+func TestHandshakeByteByByte(t *testing.T) {
+	client, server := gonet.Pipe()
+	defer client.Close()
+	defer server.Close()
+	const response = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: upgrade\r\n\r\n"
+	go func() {
+		for _, b := range []byte(response + "tunneled") {
+			if _, err := server.Write([]byte{b}); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := &ConnRF{Conn: client, Req: &http.Request{Method: http.MethodGet}, First: true}
+	var got []byte
+	buf := make([]byte, 64)
+	for len(got) < len("tunneled") {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("Read after %q: %v", got, err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "tunneled" {
+		t.Errorf("read %q", got)
+	}
+	if c.resp == nil || c.resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("response %v", c.resp)
+	}
+}
+
+func TestResponseHeaderLimits(t *testing.T) {
+	upgradeWith := func(extra http.Header) httpupgradetest.Step {
+		header := http.Header{"Upgrade": {"websocket"}, "Connection": {"upgrade"}}
+		for key, values := range extra {
+			header[key] = values
+		}
+		return httpupgradetest.Respond(http.StatusSwitchingProtocols, header, "")
+	}
+	many := make(http.Header)
+	for i := 0; i < 1000; i++ {
+		many.Add("X-Field-"+strconv.Itoa(i), "1")
+	}
+	for _, test := range []struct {
+		name   string
+		header http.Header
+		ok     bool
+	}{
+		{"15 KB", http.Header{"X-Pad": {strings.Repeat("a", 15<<10)}}, true},
+		{"64 KB", http.Header{"X-Pad": {strings.Repeat("a", 64<<10)}}, false},
+		{"1000 fields", many, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := dialFaulty(t, context.Background(), &Config{}, upgradeWith(test.header))
+			if test.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+				return
+			}
+			requireStage(t, err, StageResponse, "")
+			if !goerrors.Is(err, ErrResponseHeaderTooLarge) {
+				t.Errorf("got %v, want ErrResponseHeaderTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestTLSMismatch(t *testing.T) {
+	// a TLS server answering the plaintext request with an alert or its own
+	// handshake record
+	for _, record := range [][]byte{{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x46}, {0x16, 0x03, 0x03, 0x00, 0x00}} {
+		_, err := dialFaulty(t, context.Background(), &Config{}, httpupgradetest.Raw(record))
+		requireStage(t, err, StageResponse, "server appears to require TLS")
+	}
+
+	// a plaintext server answering the TLS client hello
+	s, err := httpupgradetest.NewFaultyServer(httpupgradetest.Respond(http.StatusBadRequest, nil, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.Addr().(*net.TCPAddr)
+	dest := net.TCPDestination(net.IPAddress(addr.IP), net.Port(addr.Port))
+	_, err = Dial(context.Background(), dest, &internet.MemoryStreamConfig{
+		ProtocolSettings: &Config{},
+		SecuritySettings: &tls.Config{AllowInsecure: true},
+	})
+	requireStage(t, err, StageTLS, "plaintext")
+
+	recordErr := gotls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}
+	copy(recordErr.RecordHeader[:], "HTTP/")
+	if err := tlsMismatch(recordErr); !strings.Contains(err.Error(), "plaintext") {
+		t.Errorf("tlsMismatch(%v) = %v", recordErr, err)
+	}
+	other := goerrors.New("handshake failure")
+	if err := tlsMismatch(other); err != other {
+		t.Errorf("tlsMismatch changed an unrelated error to %v", err)
+	}
+}
+
+// failingConn fails reads and writes with readErr and writeErr where set,
+// accepts and discards writes otherwise, and counts its closes.
+type failingConn struct {
+	gonet.Conn
+	readErr  error
+	writeErr error
+	closes   atomic.Int32
+}
+
+func (c *failingConn) Read(b []byte) (int, error) {
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	return len(b), nil
+}
+
+func (c *failingConn) Close() error {
+	c.closes.Add(1)
+	return c.Conn.Close()
+}
+
+// connDialer is a SystemDialer handing out conn and counting its dials.
+type connDialer struct {
+	conn  gonet.Conn
+	dials atomic.Int32
+}
+
+func (d *connDialer) Dial(ctx context.Context, source net.Address, dest net.Destination, sockopt *internet.SocketConfig) (net.Conn, error) {
+	d.dials.Add(1)
+	if d.conn == nil {
+		return nil, goerrors.New("no conn to hand out")
+	}
+	return d.conn, nil
+}
+
+func (*connDialer) DestIpAddress() net.IP {
+	return nil
+}
+
+func TestDialUDP(t *testing.T) {
+	// a dialer handing out nothing, so any attempt to open a socket shows
+	dialer := connDialer{}
+	internet.UseAlternativeSystemDialer(&dialer)
+	t.Cleanup(func() { internet.UseAlternativeSystemDialer(nil) })
+
+	dest := net.UDPDestination(net.DomainAddress("example.com"), 443)
+	_, err := Dial(context.Background(), dest, &internet.MemoryStreamConfig{ProtocolSettings: &Config{}})
+	requireStage(t, err, StageConnect, "")
+	if !goerrors.Is(err, ErrUDPDestination) {
+		t.Errorf("got %v, want ErrUDPDestination", err)
+	}
+	if dialer.dials.Load() != 0 {
+		t.Error("a socket was opened for a UDP destination")
+	}
+}
+
+func TestFailedDialClosesOnce(t *testing.T) {
+	failure := goerrors.New("injected failure")
+	for _, test := range []struct {
+		stage    Stage
+		tls      bool
+		readErr  error
+		writeErr error
+	}{
+		{StageTLS, true, failure, nil},
+		{StageRequest, false, nil, failure},
+		{StageResponse, false, failure, nil},
+	} {
+		t.Run(string(test.stage), func(t *testing.T) {
+			client, server := gonet.Pipe()
+			defer server.Close()
+			conn := &failingConn{Conn: client, readErr: test.readErr, writeErr: test.writeErr}
+			internet.UseAlternativeSystemDialer(&connDialer{conn: conn})
+			t.Cleanup(func() { internet.UseAlternativeSystemDialer(nil) })
+
+			streamSettings := &internet.MemoryStreamConfig{ProtocolSettings: &Config{}}
+			if test.tls {
+				streamSettings.SecuritySettings = &tls.Config{AllowInsecure: true}
+			}
+			dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+			_, err := Dial(context.Background(), dest, streamSettings)
+			requireStage(t, err, test.stage, "")
+			if n := conn.closes.Load(); n != 1 {
+				t.Errorf("closed %d times, want once", n)
+			}
+		})
+	}
+}
+
+func TestCancelDuringWrite(t *testing.T) {
+	// nothing reads the other end, so the request write blocks
+	client, server := gonet.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 80)
+	_, err := DialWithConn(ctx, client, dest, &Config{})
+	requireStage(t, err, StageRequest, "")
+	if !goerrors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("returned after %v", elapsed)
+	}
+}
+
+func TestDialWithConnTLS(t *testing.T) {
+	hosts := make(chan string, 1)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "not an upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: upgrade\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer ts.Close()
+
+	tcpConn, err := gonet.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	tlsConn := gotls.Client(tcpConn, &gotls.Config{RootCAs: roots, ServerName: "example.com"})
+	defer tlsConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	conn, err := DialWithConn(ctx, tlsConn, dest, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host := <-hosts; host != dest.NetAddr() {
+		t.Errorf("Host %q, want %q", host, dest.NetAddr())
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Errorf("echo %q, %v", b, err)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	for _, test := range []struct {
+		scheme string
+		host   string
+		want   string
+		bad    bool
+	}{
+		{"http", "", "", false},
+		{"http", "CDN.Example.com", "cdn.example.com", false},
+		{"https", "https://cdn.example.com:443", "cdn.example.com", false},
+		{"http", "https://cdn.example.com:443/", "cdn.example.com", false},
+		{"http", "HTTPS://cdn.example.com:8443", "cdn.example.com:8443", false},
+		{"https", "cdn.example.com:443", "cdn.example.com", false},
+		{"http", "cdn.example.com:443", "cdn.example.com:443", false},
+		{"http", "http://cdn.example.com:80", "cdn.example.com", false},
+		{"http", "wss://[::1]:443", "[::1]", false},
+		{"http", "[::1]:8080", "[::1]:8080", false},
+		{"http", "cdn.example.com/path", "", true},
+		{"http", "https://cdn.example.com/path", "", true},
+		{"http", "cdn example.com", "", true},
+		{"http", " cdn.example.com", "", true},
+		{"http", "cdn.example.com\t", "", true},
+		{"http", "cdn.example.com\r\nX-Injected: 1", "", true},
+		{"http", `cdn.example.com\`, "", true},
+		{"http", "ftp://cdn.example.com", "", true},
+		{"http", "https://", "", true},
+	} {
+		got, err := normalizeHost(test.scheme, test.host)
+		if (err != nil) != test.bad || got != test.want {
+			t.Errorf("normalizeHost(%q, %q) = %q, %v", test.scheme, test.host, got, err)
+		}
+	}
+}
+
+func TestBuildRequestEarlyDataPath(t *testing.T) {
+	for _, test := range []struct {
+		path   string
+		target string
+		ed     uint32
+	}{
+		{"/t", "/t", 0},
+		{"/t?ed=2048", "/t", 2048},
+		{"/t?b=1&a=2&ed=2048", "/t?b=1&a=2", 2048},
+		{"/t?ed=2048&b=1&a=2", "/t?b=1&a=2", 2048},
+		{"/t?b=1&ed=2048&a=2", "/t?b=1&a=2", 2048},
+		{"/t?x=%2F%20y&ed=10", "/t?x=%2F%20y", 10},
+		{"/t?x=a+b;c&ed=10", "/t?x=a+b;c", 10},
+		{"/t?flag&ed=10", "/t?flag", 10},
+		{"/t?%65d=10&z=1", "/t?z=1", 10},
+		{"/t?ed=abc&a=2", "/t?ed=abc&a=2", 0},
+		{"/t?ed=99999999999", "/t?ed=99999999999", 0},
+		{"/t?b=%zz&ed=10", "/t?b=%zz", 10},
+	} {
+		r, err := buildRequest("http", "example.com:80", &Config{Path: test.path})
+		if err != nil {
+			t.Errorf("%q: %v", test.path, err)
+			continue
+		}
+		if r.target != test.target || r.ed != test.ed {
+			t.Errorf("%q: target %q ed %d, want %q ed %d", test.path, r.target, r.ed, test.target, test.ed)
+		}
+	}
+}
+
+func TestRequestLineLimit(t *testing.T) {
+	overhead := len("GET  HTTP/1.1")
+	longest := "/" + strings.Repeat("a", maxRequestLineBytes-overhead-1)
+	for _, test := range []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"at the limit", longest, true},
+		{"one byte over", longest + "a", false},
+		// the ed parameter is taken out before the line is measured
+		{"at the limit with ed", longest + "?ed=2048", true},
+	} {
+		r, err := buildRequest("http", "example.com:80", &Config{Path: test.path})
+		if (err == nil) != test.ok {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		var b bytes.Buffer
+		if err := r.writeTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if line, _, _ := strings.Cut(b.String(), "\r\n"); len(line) != maxRequestLineBytes {
+			t.Errorf("%s: request line of %d bytes", test.name, len(line))
+		}
+	}
+}
+
+func TestBuildRequestConflicts(t *testing.T) {
+	for _, test := range []struct {
+		key, value string
+		ok         bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"upgrade", "WebSocket", true},
+		{"CONNECTION", "Upgrade", true},
+		{"Connection", "", true},
+		{"Upgrade", "h2c", false},
+		{"connection", "keep-alive", false},
+		{"Connection", "upgrade, keep-alive", false},
+	} {
+		_, err := buildRequest("http", "example.com:80", &Config{Header: map[string]string{test.key: test.value}})
+		if (err == nil) != test.ok {
+			t.Errorf("%s: %q: %v", test.key, test.value, err)
+		}
+	}
+}
+
+func TestBuildRequestRejectsExtensions(t *testing.T) {
+	for _, key := range []string{"Sec-WebSocket-Extensions", "sec-websocket-extensions"} {
+		_, err := buildRequest("http", "example.com:80", &Config{Header: map[string]string{key: "permessage-deflate"}})
+		if err == nil || !strings.Contains(err.Error(), "extension") {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
+
+// parseResponse parses raw as the response to a GET request.
+func parseResponse(t *testing.T, raw string) *http.Response {
+	t.Helper()
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), &http.Request{Method: http.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestValidateResponseExtensions(t *testing.T) {
+	const upgrade = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: upgrade\r\n"
+	if err := validateResponse(parseResponse(t, upgrade+"\r\n")); err != nil {
+		t.Errorf("plain upgrade: %v", err)
+	}
+	for _, ext := range []string{"permessage-deflate; client_max_window_bits", "x-unknown-extension"} {
+		err := validateResponse(parseResponse(t, upgrade+"Sec-WebSocket-Extensions: "+ext+"\r\n\r\n"))
+		if !goerrors.Is(err, ErrUnrequestedExtension) {
+			t.Errorf("%s: %v", ext, err)
+		}
+	}
+}
+
+func TestValidateResponseCodings(t *testing.T) {
+	const upgrade = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: upgrade\r\n"
+	for _, field := range []string{"Transfer-Encoding: chunked", "Content-Encoding: gzip"} {
+		err := validateResponse(parseResponse(t, upgrade+field+"\r\n\r\n"))
+		if err == nil || !strings.Contains(err.Error(), "coding") {
+			t.Errorf("%s: %v", field, err)
+		}
+	}
+
+	header := http.Header{"Upgrade": {"websocket"}, "Connection": {"upgrade"}, "Transfer-Encoding": {"chunked"}}
+	_, err := dialFaulty(t, context.Background(), &Config{}, httpupgradetest.Respond(http.StatusSwitchingProtocols, header, ""))
+	requireStage(t, err, StageValidate, "coding")
+}
+
+func TestBodySnippet(t *testing.T) {
+	long := strings.Repeat("x", errorBodySnippetSize+100)
+	for _, test := range []struct {
+		name, raw, want string
+	}{
+		{"chunked", "HTTP/1.1 502 Bad Gateway\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nupstr\r\n9\r\neam down\n\r\n0\r\n\r\n", "upstream down"},
+		{"long chunked", "HTTP/1.1 502 Bad Gateway\r\nTransfer-Encoding: chunked\r\n\r\n" + strconv.FormatInt(int64(len(long)), 16) + "\r\n" + long + "\r\n0\r\n\r\n", long[:errorBodySnippetSize]},
+		{"content length", "HTTP/1.1 403 Forbidden\r\nContent-Length: 6\r\n\r\ndenied", "denied"},
+		{"unframed", "HTTP/1.1 403 Forbidden\r\n\r\ndenied", ""},
+	} {
+		if got := bodySnippet(parseResponse(t, test.raw)); got != test.want {
+			t.Errorf("%s: snippet %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	header := http.Header{"Transfer-Encoding": {"chunked"}}
+	_, err := dialFaulty(t, context.Background(), &Config{}, httpupgradetest.Respond(http.StatusBadGateway, header, "d\r\nupstream down\r\n0\r\n\r\n"))
+	requireStage(t, err, StageValidate, `"upstream down"`)
+}
+
+func TestDialInfoReportsSentHost(t *testing.T) {
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	config := &Config{Host: "https://CDN.example.com:443/"}
+	r, err := buildRequest("https", dest.NetAddr(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := newDialInfo(dest, "https", config); info.host != r.host {
+		t.Errorf("dial info host %q, request host %q", info.host, r.host)
+	}
+	if info := newDialInfo(dest, "https", &Config{}); info.host != dest.NetAddr() {
+		t.Errorf("dial info host %q, want %q", info.host, dest.NetAddr())
+	}
+}
+
+// closeRecorder records Close calls, and the flushes of the Flushers it
+// hands out, in events.
+type closeRecorder struct {
+	gonet.Conn
+	events []string
+	err    error
+}
+
+func (c *closeRecorder) Close() error {
+	c.events = append(c.events, "close")
+	return c.err
+}
+
+type recordingFlusher struct {
+	name string
+	conn *closeRecorder
+	err  error
+}
+
+func (f *recordingFlusher) Flush() error {
+	f.conn.events = append(f.conn.events, "flush "+f.name)
+	return f.err
+}
+
+func TestClose(t *testing.T) {
+	conn := &closeRecorder{err: goerrors.New("close failed")}
+	c := &ConnRF{Conn: conn, Flushers: []Flusher{
+		&recordingFlusher{name: "a", conn: conn, err: goerrors.New("flush failed")},
+		&recordingFlusher{name: "b", conn: conn},
+	}}
+	err := c.Close()
+	if err == nil || !strings.Contains(err.Error(), "flush failed") || !strings.Contains(err.Error(), "close failed") {
+		t.Errorf("Close: %v, want both failures", err)
+	}
+	// a failed flush neither stops later ones nor the close
+	if got := strings.Join(conn.events, ", "); got != "flush a, flush b, close" {
+		t.Errorf("events %q", got)
+	}
+	if again := c.Close(); again == nil || again.Error() != err.Error() {
+		t.Errorf("second Close: %v, want %v", again, err)
+	}
+	if len(conn.events) != 3 {
+		t.Errorf("second Close repeated work: %q", conn.events)
+	}
+
+	conn = &closeRecorder{}
+	c = &ConnRF{Conn: conn, Flushers: []Flusher{&recordingFlusher{name: "a", conn: conn}}}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestPeekBounds(t *testing.T) {
+	client, server := gonet.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := &ConnRF{Conn: client}
+	if _, err := c.Peek(-1); err != bufio.ErrNegativeCount {
+		t.Errorf("Peek(-1): %v", err)
+	}
+	if _, err := c.Peek(maxPeekBytes + 1); err != bufio.ErrBufferFull {
+		t.Errorf("Peek(maxPeekBytes+1): %v", err)
+	}
+	go server.Write([]byte("abc"))
+	if b, err := c.Peek(3); err != nil || string(b) != "abc" {
+		t.Errorf("Peek(3) = %q, %v", b, err)
+	}
+}
+
+func TestPeekAfterDirectRead(t *testing.T) {
+	client, server := gonet.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go server.Write([]byte("abcdef"))
+
+	c := &ConnRF{Conn: client}
+	if b, err := c.Peek(2); err != nil || string(b) != "ab" {
+		t.Fatalf("Peek(2) = %q, %v", b, err)
+	}
+	buf := make([]byte, 2)
+	// the first read drains what was peeked, the second goes direct
+	for _, want := range []string{"ab", "cd"} {
+		if n, err := c.Read(buf); err != nil || string(buf[:n]) != want {
+			t.Fatalf("Read = %q, %v; want %q", buf[:n], err, want)
+		}
+	}
+	if _, err := c.Peek(1); err != ErrPeekAfterRead {
+		t.Errorf("Peek after a direct read: %v", err)
+	}
+}
+
+func TestReadPeekOrdering(t *testing.T) {
+	const total = 1 << 9
+	client, server := gonet.Pipe()
+	defer client.Close()
+	go func() {
+		b := make([]byte, total)
+		for i := range b {
+			b[i] = byte(i)
+		}
+		for off := 0; off < total; off += 7 {
+			server.Write(b[off:min(off+7, total)])
+		}
+		server.Close()
+	}()
+
+	c := &ConnRF{Conn: lateConn{client}}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				c.Peek(3)
+			}
+		}
+	}()
+
+	buf := make([]byte, 5)
+	next := 0
+	for {
+		n, err := c.Read(buf)
+		for _, b := range buf[:n] {
+			if b != byte(next) {
+				t.Fatalf("byte %d: got %d", next, b)
+			}
+			next++
+		}
+		if err != nil {
+			break
+		}
+	}
+	if next != total {
+		t.Fatalf("read %d bytes, want %d", next, total)
+	}
+}
+
+// lateConn delays each read a little before it reaches the conn, widening
+// the window in which a Read and a Peek could race for the same bytes.
+type lateConn struct {
+	gonet.Conn
+}
+
+func (c lateConn) Read(b []byte) (int, error) {
+	time.Sleep(10 * time.Microsecond)
+	return c.Conn.Read(b)
+}
+
+// instantConn fills every read straight away.
+type instantConn struct {
+	gonet.Conn
+}
+
+func (instantConn) Read(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// benchmarkRead reads from conn in calls as small as a framed protocol's.
+func benchmarkRead(b *testing.B, conn gonet.Conn) {
+	buf := make([]byte, 64)
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		conn.Read(buf)
+	}
+}
+
+func BenchmarkReadDirect(b *testing.B) {
+	benchmarkRead(b, instantConn{})
+}
+
+func BenchmarkReadConnRF(b *testing.B) {
+	benchmarkRead(b, &ConnRF{Conn: instantConn{}})
+}
@@ -0,0 +1,76 @@
+package httpupgrade
+
+import (
+	goerrors "errors"
+
+	"github.com/xtls/xray-core/common/net"
+)
+
+// HandshakeError describes a failed dial: the stage it failed at and what it
+// was talking to.
+type HandshakeError struct {
+	Stage      Stage
+	Dest       net.Destination
+	ServerName string
+	Host       string
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	return "httpupgrade " + string(e.Stage) + " failed (dest: " + e.Dest.String() +
+		", sni: " + e.ServerName + ", host: " + e.Host + "): " + e.Err.Error()
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// stageOf returns the stage err is attributed to, or fallback if it is not a
+// HandshakeError.
+func stageOf(err error, fallback Stage) Stage {
+	var handshakeErr *HandshakeError
+	if goerrors.As(err, &handshakeErr) {
+		return handshakeErr.Stage
+	}
+	return fallback
+}
+
+// dialInfo is what the errors of a dial are attributed to.
+type dialInfo struct {
+	dest       net.Destination
+	serverName string
+	host       string
+}
+
+// newDialInfo describes a dial to dest with the given scheme and config. Its
+// host is the Host header the dial sends, as far as the config allows to tell.
+func newDialInfo(dest net.Destination, scheme string, transportConfiguration *Config) *dialInfo {
+	host, err := normalizeHost(scheme, transportConfiguration.Host)
+	if err != nil {
+		// building the request fails on it later, with a better error
+		host = transportConfiguration.Host
+	}
+	if host == "" {
+		host = dest.NetAddr()
+	}
+	return &dialInfo{dest: dest, host: host}
+}
+
+// wrap attributes err to stage of the dial described by d. Errors already
+// attributed, and all errors when d is nil, are returned as they are.
+func (d *dialInfo) wrap(stage Stage, err error) error {
+	if err == nil || d == nil {
+		return err
+	}
+	var handshakeErr *HandshakeError
+	if goerrors.As(err, &handshakeErr) {
+		return err
+	}
+	return &HandshakeError{
+		Stage:      stage,
+		Dest:       d.dest,
+		ServerName: d.serverName,
+		Host:       d.host,
+		Err:        err,
+	}
+}
@@ -0,0 +1,92 @@
+package httpupgrade
+
+import (
+	"context"
+	goerrors "errors"
+	gonet "net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/httpupgrade/httpupgradetest"
+	"github.com/xtls/xray-core/transport/internet/tls"
+)
+
+func TestHandshakeErrorFields(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/close" {
+			if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	addr := ts.Listener.Addr().(*gonet.TCPAddr)
+	// a port nothing listens on
+	l, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := net.Port(l.Addr().(*gonet.TCPAddr).Port)
+	l.Close()
+	plain, err := httpupgradetest.NewFaultyServer(httpupgradetest.Upgrade())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plainPort := net.Port(plain.Addr().(*gonet.TCPAddr).Port)
+
+	for _, test := range []struct {
+		stage Stage
+		port  net.Port
+		path  string
+		// sni is the server name the error should report
+		sni string
+	}{
+		{StageConnect, closedPort, "/", ""},
+		{StageTLS, plainPort, "/", "tunnel.example"},
+		{StageRequest, net.Port(addr.Port), "/", "tunnel.example"},
+		{StageResponse, net.Port(addr.Port), "/close", "tunnel.example"},
+		{StageValidate, net.Port(addr.Port), "/", "tunnel.example"},
+	} {
+		t.Run(string(test.stage), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ctx = ContextWithResolver(ctx, &countingResolver{ips: []net.IP{addr.IP}})
+			if test.stage == StageRequest {
+				// fail the request write by cancelling right after TLS
+				ctx = ContextWithTracer(ctx, &Tracer{TLSHandshakeDone: func(error) { cancel() }})
+			}
+			streamSettings := &internet.MemoryStreamConfig{
+				ProtocolSettings: &Config{Host: "cdn.example.com", Path: test.path},
+				SecuritySettings: &tls.Config{AllowInsecure: true},
+			}
+			dest := net.TCPDestination(net.DomainAddress("tunnel.example"), test.port)
+			_, err := Dial(ctx, dest, streamSettings)
+
+			var handshakeErr *HandshakeError
+			if !goerrors.As(err, &handshakeErr) {
+				t.Fatalf("got %v, want a HandshakeError", err)
+			}
+			if handshakeErr.Stage != test.stage {
+				t.Errorf("stage %q: %v", handshakeErr.Stage, err)
+			}
+			if handshakeErr.Dest != dest {
+				t.Errorf("dest %v, want %v", handshakeErr.Dest, dest)
+			}
+			if handshakeErr.ServerName != test.sni {
+				t.Errorf("server name %q, want %q", handshakeErr.ServerName, test.sni)
+			}
+			if handshakeErr.Host != "cdn.example.com" {
+				t.Errorf("host %q", handshakeErr.Host)
+			}
+			if handshakeErr.Err == nil {
+				t.Error("no underlying error")
+			}
+		})
+	}
+}
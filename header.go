@@ -0,0 +1,113 @@
+package httpupgrade
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/xtls/xray-core/common/errors"
+	"golang.org/x/net/http/httpguts"
+)
+
+// defaultUserAgent is what http.Request.Write sends when no User-Agent is set.
+const defaultUserAgent = "Go-http-client/1.1"
+
+// headerField is a single request header line, kept exactly as given.
+type headerField struct {
+	Key   string
+	Value string
+}
+
+// orderedHeader is a list of header fields. Unlike http.Header it keeps
+// insertion order, key casing and duplicate keys, so the request can be
+// written byte for byte as built.
+type orderedHeader []headerField
+
+// Add appends a field without touching existing ones.
+func (h *orderedHeader) Add(key, value string) {
+	*h = append(*h, headerField{Key: key, Value: value})
+}
+
+// Get returns the value of the first field whose key matches
+// case-insensitively.
+func (h orderedHeader) Get(key string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Key, key) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// headerFromConfig builds the request's header fields from configured ones,
+// keeping their keys exactly as written, so that keys differing only in case
+// are all sent. User-Agent comes first, defaulting to what http.Request.Write
+// sends, followed by the remaining fields and any mandatory upgrade field not
+// configured already, sorted by key. Host is skipped since it is taken from
+// the request itself.
+func headerFromConfig(configured map[string]string) orderedHeader {
+	keys := make([]string, 0, len(configured))
+	for key := range configured {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var header, fields orderedHeader
+	userAgentSet := false
+	for _, key := range keys {
+		value := strings.Trim(configured[key], " \t")
+		switch {
+		case strings.EqualFold(key, "User-Agent"):
+			userAgentSet = true
+			// like http.Request.Write, an empty User-Agent means none
+			if value != "" {
+				header.Add(key, value)
+			}
+		case strings.EqualFold(key, "Host"):
+			// Host comes from the request
+		default:
+			fields.Add(key, value)
+		}
+	}
+	if !userAgentSet {
+		header.Add("User-Agent", defaultUserAgent)
+	}
+	for key, value := range mandatoryHeaders {
+		if fields.Get(key) == "" {
+			fields.Add(key, value)
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].Key < fields[j].Key
+	})
+	return append(header, fields...)
+}
+
+// writeRequest writes an HTTP/1.1 request head to w in a single Write, with
+// the fields of header emitted verbatim and in order after Host.
+func writeRequest(w io.Writer, method, target, host string, header orderedHeader) error {
+	// like http.Request.Write, send internationalized names as punycode
+	asciiHost, err := httpguts.PunycodeHostPort(host)
+	if err != nil {
+		return errors.New("invalid Host header: ", host).Base(err)
+	}
+	if !httpguts.ValidHostHeader(asciiHost) {
+		return errors.New("invalid Host header: ", host)
+	}
+	var b bytes.Buffer
+	b.WriteString(method + " " + target + " HTTP/1.1\r\n")
+	b.WriteString("Host: " + asciiHost + "\r\n")
+	for _, f := range header {
+		if !httpguts.ValidHeaderFieldName(f.Key) {
+			return errors.New("invalid header field name: ", f.Key)
+		}
+		if !httpguts.ValidHeaderFieldValue(f.Value) {
+			return errors.New("invalid header field value for ", f.Key)
+		}
+		b.WriteString(f.Key + ": " + f.Value + "\r\n")
+	}
+	b.WriteString("\r\n")
+	_, err = w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,123 @@
+package httpupgrade
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+// TestWriteRequestMatchesNetHTTP checks that with canonical keys the request
+// is written exactly as http.Request.Write wrote it before the raw writer.
+func TestWriteRequestMatchesNetHTTP(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		addr   string
+		config *Config
+	}{
+		{"bare", "example.com:80", &Config{}},
+		{"host and path", "1.2.3.4:80", &Config{Host: "cdn.example.com", Path: "/tunnel?a=1&ed=2048"}},
+		{"headers", "example.com:80", &Config{Header: map[string]string{
+			"X-Forwarded-For": "1.1.1.1",
+			"Accept-Language": " en-US ",
+			"Pragma":          "no-cache",
+		}}},
+		{"user agent", "example.com:80", &Config{Header: map[string]string{"User-Agent": "Mozilla/5.0"}}},
+		{"empty user agent", "example.com:80", &Config{Header: map[string]string{"User-Agent": ""}}},
+		{"internationalized host", "example.com:80", &Config{Host: "bücher.example"}},
+		{"internationalized addr", "bücher.example:8080", &Config{}},
+		{"method and target", "example.com:80", &Config{Path: "/CONNECT example.com:443"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := buildRequest("http", test.addr, test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want bytes.Buffer
+			if err := r.writeTo(&got); err != nil {
+				t.Fatal(err)
+			}
+			req := *r.req
+			req.Header = make(http.Header)
+			for key, value := range test.config.Header {
+				req.Header.Add(key, value)
+			}
+			for key, value := range mandatoryHeaders {
+				req.Header.Set(key, value)
+			}
+			if err := req.Write(&want); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != want.String() {
+				t.Errorf("got\n%q\nwant\n%q", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestWriteRequestVerbatim(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		header map[string]string
+		want   string
+	}{
+		{
+			"mixed case and duplicates",
+			map[string]string{
+				"accept-language": "en",
+				"X-Custom":        "1",
+				"x-custom":        "2",
+				"user-agent":      "UA",
+			},
+			"user-agent: UA\r\n" +
+				"Connection: upgrade\r\n" +
+				"Upgrade: websocket\r\n" +
+				"X-Custom: 1\r\n" +
+				"accept-language: en\r\n" +
+				"x-custom: 2\r\n",
+		},
+		{
+			"upgrade fields as configured",
+			map[string]string{
+				"connection": "Upgrade",
+				"UPGRADE":    "WebSocket",
+			},
+			"User-Agent: Go-http-client/1.1\r\n" +
+				"UPGRADE: WebSocket\r\n" +
+				"connection: Upgrade\r\n",
+		},
+		{
+			"host and empty user agent skipped",
+			map[string]string{
+				"host":                   "ignored.example",
+				"User-Agent":             "",
+				"Sec-WebSocket-Protocol": "chat",
+			},
+			"Connection: upgrade\r\n" +
+				"Sec-WebSocket-Protocol: chat\r\n" +
+				"Upgrade: websocket\r\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := buildRequest("http", "example.com", &Config{Header: test.header})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			if err := r.writeTo(&got); err != nil {
+				t.Fatal(err)
+			}
+			want := "GET / HTTP/1.1\r\nHost: example.com\r\n" + test.want + "\r\n"
+			if got.String() != want {
+				t.Errorf("got\n%q\nwant\n%q", got.String(), want)
+			}
+		})
+	}
+}
+
+func TestWriteRequestRejectsInvalidHost(t *testing.T) {
+	for _, host := range []string{"a\nb.example", "a b.example"} {
+		if err := writeRequest(new(bytes.Buffer), "GET", "/", host, nil); err == nil {
+			t.Errorf("%q: expected an error", host)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Package httpupgradetest provides a misbehaving httpupgrade server for
+// exercising how dialers cope with broken or hostile peers.
+package httpupgradetest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Conn is an accepted connection as seen by a Step.
+type Conn struct {
+	net.Conn
+	// Request is the request the client sent, nil if it could not be read.
+	Request *http.Request
+
+	// remaining is how many more bytes may be written before the connection
+	// is closed, negative for no limit.
+	remaining int
+}
+
+// Write writes b, closing the connection instead of writing past the limit
+// set by CloseAfterBytes.
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.remaining < 0 {
+		return c.Conn.Write(b)
+	}
+	if len(b) <= c.remaining {
+		n, err := c.Conn.Write(b)
+		c.remaining -= n
+		return n, err
+	}
+	n, _ := c.Conn.Write(b[:c.remaining])
+	c.remaining = 0
+	c.Conn.Close()
+	return n, io.ErrClosedPipe
+}
+
+// Step is one action a FaultyServer takes on an accepted connection. A Step
+// that returns an error ends the script for that connection.
+type Step func(*Conn) error
+
+// Silence holds the connection open without sending anything until the
+// client closes it.
+func Silence() Step {
+	return func(c *Conn) error {
+		_, err := io.Copy(io.Discard, c.Conn)
+		return err
+	}
+}
+
+// Respond sends a response with the given status, header fields and body.
+// Header fields are written as given, so a Content-Length is only sent if
+// header carries one.
+func Respond(status int, header http.Header, body string) Step {
+	return func(c *Conn) error {
+		w := bufio.NewWriter(c)
+		fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+		for key, values := range header {
+			for _, value := range values {
+				fmt.Fprintf(w, "%s: %s\r\n", key, value)
+			}
+		}
+		w.WriteString("\r\n")
+		w.WriteString(body)
+		return w.Flush()
+	}
+}
+
+// Upgrade accepts the upgrade with a well-formed 101 response.
+func Upgrade() Step {
+	return Respond(http.StatusSwitchingProtocols, http.Header{
+		"Connection": {"upgrade"},
+		"Upgrade":    {"websocket"},
+	}, "")
+}
+
+// CloseAfterBytes closes the connection once n more bytes have been written,
+// truncating whatever the following steps send.
+func CloseAfterBytes(n int) Step {
+	return func(c *Conn) error {
+		c.remaining = n
+		return nil
+	}
+}
+
+// Delay waits for d before the next step.
+func Delay(d time.Duration) Step {
+	return func(c *Conn) error {
+		time.Sleep(d)
+		return nil
+	}
+}
+
+// Garbage sends n random bytes.
+func Garbage(n int) Step {
+	return func(c *Conn) error {
+		b := make([]byte, n)
+		rand.Read(b)
+		_, err := c.Write(b)
+		return err
+	}
+}
+
+// Raw sends b as is.
+func Raw(b []byte) Step {
+	return func(c *Conn) error {
+		_, err := c.Write(b)
+		return err
+	}
+}
+
+// FaultyServer accepts connections on a local port, reads the request each
+// client sends and then runs its steps against the connection in order,
+// closing it once they are done.
+type FaultyServer struct {
+	listener net.Listener
+	steps    []Step
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// NewFaultyServer starts a FaultyServer on a loopback port running steps on
+// every connection.
+func NewFaultyServer(steps ...Step) (*FaultyServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &FaultyServer{
+		listener: listener,
+		steps:    steps,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *FaultyServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the server, closes the connections it still holds and waits
+// for their scripts to end.
+func (s *FaultyServer) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *FaultyServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		// Close may have run between Accept and here
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *FaultyServer) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	c := &Conn{Conn: conn, remaining: -1}
+	if req, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+		c.Request = req
+	}
+	for _, step := range s.steps {
+		if err := step(c); err != nil {
+			return
+		}
+	}
+}
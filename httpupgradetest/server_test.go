@@ -0,0 +1,158 @@
+package httpupgradetest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// dial starts a FaultyServer running steps, sends it a request and returns
+// the client side of the connection.
+func dial(t *testing.T, steps ...Step) (*FaultyServer, net.Conn) {
+	t.Helper()
+	s, err := NewFaultyServer(steps...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.Write([]byte("GET /path HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return s, conn
+}
+
+func TestRespond(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	record := func(c *Conn) error {
+		requests <- c.Request
+		return nil
+	}
+	_, conn := dial(t, record, Respond(520, http.Header{"X-Test": {"a", "b"}}, "oops"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 520 {
+		t.Errorf("status %d, want 520", resp.StatusCode)
+	}
+	if got := resp.Header.Values("X-Test"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("X-Test %q", got)
+	}
+	// without a Content-Length the body runs until the server closes
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "oops" {
+		t.Errorf("body %q, %v", body, err)
+	}
+
+	req := <-requests
+	if req == nil || req.URL.Path != "/path" || req.Host != "example.com" || req.Header.Get("Upgrade") != "websocket" {
+		t.Errorf("request %+v", req)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	_, conn := dial(t, Upgrade())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "websocket" || resp.Header.Get("Connection") != "upgrade" {
+		t.Errorf("response %s %v", resp.Status, resp.Header)
+	}
+}
+
+func TestCloseAfterBytes(t *testing.T) {
+	_, conn := dial(t, CloseAfterBytes(5), Raw([]byte("hello world")), Raw([]byte("never sent")))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("read %q, want %q", b, "hello")
+	}
+}
+
+func TestGarbage(t *testing.T) {
+	_, conn := dial(t, Garbage(1000))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 1000 {
+		t.Errorf("read %d bytes, want 1000", len(b))
+	}
+}
+
+func TestDelay(t *testing.T) {
+	start := time.Now()
+	_, conn := dial(t, Delay(50*time.Millisecond), Raw([]byte("x")))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("answered after %v", elapsed)
+	}
+}
+
+func TestSilence(t *testing.T) {
+	done := make(chan struct{})
+	finish := func(c *Conn) error {
+		close(done)
+		return nil
+	}
+	_, conn := dial(t, Silence(), finish)
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read %d bytes, %v; want a timeout", n, err)
+	}
+	select {
+	case <-done:
+		t.Fatal("silence ended while the client was connected")
+	default:
+	}
+
+	// silence lasts until the client goes away
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("silence outlived the client")
+	}
+}
+
+func TestCloseWithLiveConnections(t *testing.T) {
+	s, conn := dial(t, Silence())
+	// make sure the server holds the connection before closing
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	conn.Read(make([]byte, 1))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return with a live connection")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after Close: %v, want EOF", err)
+	}
+	if _, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		t.Error("dial after Close succeeded")
+	}
+}
@@ -0,0 +1,331 @@
+package httpupgrade
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	goerrors "errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+const (
+	// serverHandshakeTimeout bounds how long a client may take to send each
+	// request before the upgrade.
+	serverHandshakeTimeout = 16 * time.Second
+	// maxRequestsPerConnection bounds how many requests a connection may
+	// carry, the upgrade included.
+	maxRequestsPerConnection = 100
+	// maxRequestBodyBytes bounds how much of a rejected request's body is
+	// read and discarded to reach the next request.
+	maxRequestBodyBytes = 64 << 10
+	// rejectionQueueSize bounds how many rejections may wait for the
+	// OnRejected hook before further ones are dropped.
+	rejectionQueueSize = 64
+)
+
+// RejectReason classifies why a request was rejected.
+type RejectReason string
+
+const (
+	RejectMalformed  RejectReason = "malformed request"
+	RejectHost       RejectReason = "bad host"
+	RejectPath       RejectReason = "bad path"
+	RejectNotUpgrade RejectReason = "not an upgrade"
+)
+
+// RejectionInfo describes a request the listener turned away.
+type RejectionInfo struct {
+	// Source is the IP address of the connection's remote end, without the
+	// port, so that rejections from one client can be grouped.
+	Source string       `json:"source"`
+	Reason RejectReason `json:"reason"`
+	// Host and Path are empty when the request could not be parsed.
+	Host string    `json:"host,omitempty"`
+	Path string    `json:"path,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// ListenerOption configures a listener made by NewListener or Serve.
+type ListenerOption func(*upgradeListener)
+
+// OnRejected calls hook for every rejected request. Calls are made one at
+// a time from a separate goroutine, so a slow hook never holds up accepting;
+// rejections arriving while the queue is full are dropped and counted, see
+// RejectionsDropped.
+func OnRejected(hook func(RejectionInfo)) ListenerOption {
+	return func(l *upgradeListener) {
+		l.onRejected = hook
+	}
+}
+
+// JSONLinesRejections returns an OnRejected hook appending each rejection to w
+// as a line of JSON, for tools like fail2ban to tail. Write errors are
+// ignored.
+func JSONLinesRejections(w io.Writer) func(RejectionInfo) {
+	encoder := json.NewEncoder(w)
+	return func(info RejectionInfo) {
+		encoder.Encode(info)
+	}
+}
+
+// RejectionsDropped returns how many rejections l dropped because its
+// OnRejected hook fell behind.
+func RejectionsDropped(l net.Listener) uint64 {
+	if l, ok := l.(*upgradeListener); ok {
+		return l.dropped.Load()
+	}
+	return 0
+}
+
+type upgradeListener struct {
+	net.Listener
+	// host is the host name clients must send, without its port, or empty
+	// to accept any, and target the request-target they must use.
+	host   string
+	target string
+	conns  chan net.Conn
+
+	onRejected func(RejectionInfo)
+	rejections chan RejectionInfo
+	dropped    atomic.Uint64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+}
+
+// NewListener wraps inner so that Accept returns connections that have
+// already completed the upgrade handshake described by config, with any bytes
+// the client sent behind its request delivered by the first reads. Requests
+// that don't match config are answered and closed internally and never
+// surface from Accept. It is the server-side mirror of DialWithConn.
+func NewListener(inner net.Listener, config *Config, opts ...ListenerOption) (net.Listener, error) {
+	if inner == nil {
+		return nil, errors.New("nil inner listener")
+	}
+	if config == nil {
+		config = new(Config)
+	}
+	r, err := buildRequest("http", "", config)
+	if err != nil {
+		return nil, err
+	}
+	l := &upgradeListener{
+		Listener: inner,
+		host:     hostname(r.req.Host),
+		target:   r.target,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.onRejected != nil {
+		l.rejections = make(chan RejectionInfo, rejectionQueueSize)
+		go l.reportRejections()
+	}
+	go l.keepAccepting()
+	return l, nil
+}
+
+// Serve accepts upgraded connections on inner, as NewListener would, and runs
+// handler for each of them in its own goroutine. The connection is closed once
+// handler returns unless handler called TakeOver on it. Serve blocks until
+// accepting fails and returns that error.
+func Serve(inner net.Listener, config *Config, handler func(net.Conn), opts ...ListenerOption) error {
+	l, err := NewListener(inner, config, opts...)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			handler(conn)
+			if !conn.(*ConnRF).takenOver.Load() {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// TakeOver stops Serve from closing conn when the handler it was passed to
+// returns, leaving the caller responsible for it.
+func TakeOver(conn net.Conn) {
+	if c, ok := conn.(*ConnRF); ok {
+		c.takenOver.Store(true)
+	}
+}
+
+func (l *upgradeListener) keepAccepting() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.shutdown(err)
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *upgradeListener) handle(conn net.Conn) {
+	upgraded, err := l.serverHandshake(conn)
+	if err != nil {
+		errors.LogInfoInner(context.Background(), err, "rejected upgrade from ", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	select {
+	case l.conns <- upgraded:
+	case <-l.closed:
+		upgraded.Close()
+	}
+}
+
+// serverHandshake reads requests from conn until one matches the listener's
+// config and accepts it. Other requests are answered with a rejection that,
+// like a regular web server's, keeps the connection open for the next request
+// unless the client asked to close it or maxRequestsPerConnection is reached.
+func (l *upgradeListener) serverHandshake(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	for served := 1; ; served++ {
+		conn.SetDeadline(time.Now().Add(serverHandshakeTimeout))
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			// a client going away between requests or idling out is not
+			// worth reporting
+			var netErr net.Error
+			if err != io.EOF && !(goerrors.As(err, &netErr) && netErr.Timeout()) {
+				l.reject(conn, RejectMalformed, nil)
+			}
+			return nil, err
+		}
+		reason, err := l.checkRequest(req)
+		if err == nil {
+			break
+		}
+		l.reject(conn, reason, req)
+		keepAlive := !req.Close && served < maxRequestsPerConnection
+		// the next request starts behind this one's body, which is only
+		// worth skipping while it is small; a chunked one has no declared
+		// length and is caught while reading
+		var discarded int64
+		var derr error
+		if req.ContentLength <= maxRequestBodyBytes {
+			discarded, derr = io.Copy(io.Discard, io.LimitReader(req.Body, maxRequestBodyBytes+1))
+		}
+		if req.ContentLength > maxRequestBodyBytes || discarded > maxRequestBodyBytes {
+			conn.Write([]byte("HTTP/1.1 413 Request Entity Too Large\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			return nil, errors.New("request body exceeds ", maxRequestBodyBytes, " bytes").Base(err)
+		}
+		if derr != nil {
+			keepAlive = false
+		}
+		if !keepAlive {
+			conn.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			return nil, err
+		}
+		if _, werr := conn.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")); werr != nil {
+			return nil, werr
+		}
+		errors.LogInfoInner(context.Background(), err, "rejected request from ", conn.RemoteAddr(), ", keeping the connection")
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: upgrade\r\nUpgrade: websocket\r\n\r\n")); err != nil {
+		return nil, err
+	}
+	upgraded := &ConnRF{Conn: conn}
+	if n := reader.Buffered(); n > 0 {
+		upgraded.leftover, _ = reader.Peek(n)
+	}
+	return upgraded, nil
+}
+
+func (l *upgradeListener) checkRequest(req *http.Request) (RejectReason, error) {
+	if l.host != "" && !strings.EqualFold(hostname(req.Host), l.host) {
+		return RejectHost, errors.New("bad host: ", req.Host)
+	}
+	if req.RequestURI != l.target && req.URL.Path != l.target {
+		return RejectPath, errors.New("bad path: ", req.RequestURI)
+	}
+	if strings.ToLower(req.Header.Get("Upgrade")) != "websocket" ||
+		!strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade") {
+		return RejectNotUpgrade, errors.New("unrecognized request")
+	}
+	return "", nil
+}
+
+// hostname returns host without its port or IPv6 brackets.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// reject queues a rejection of req, nil if it could not be parsed, for the
+// OnRejected hook.
+func (l *upgradeListener) reject(conn net.Conn, reason RejectReason, req *http.Request) {
+	if l.rejections == nil {
+		return
+	}
+	info := RejectionInfo{
+		Reason: reason,
+		Time:   time.Now(),
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		info.Source = hostname(addr.String())
+	}
+	if req != nil {
+		info.Host = req.Host
+		info.Path = req.RequestURI
+	}
+	select {
+	case l.rejections <- info:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+func (l *upgradeListener) reportRejections() {
+	for {
+		select {
+		case info := <-l.rejections:
+			l.onRejected(info)
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *upgradeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.err
+	}
+}
+
+func (l *upgradeListener) Close() error {
+	l.shutdown(net.ErrClosed)
+	return l.Listener.Close()
+}
+
+func (l *upgradeListener) shutdown(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.closed)
+	})
+}
@@ -0,0 +1,444 @@
+package httpupgrade
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rejectionRecorder collects what an OnRejected hook is called with.
+type rejectionRecorder struct {
+	mu    sync.Mutex
+	infos []RejectionInfo
+	lines bytes.Buffer
+	jsonl func(RejectionInfo)
+}
+
+func (r *rejectionRecorder) hook(info RejectionInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.infos = append(r.infos, info)
+	r.jsonl(info)
+}
+
+func (r *rejectionRecorder) wait(t *testing.T, n int) []RejectionInfo {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		r.mu.Lock()
+		if len(r.infos) >= n {
+			infos := append([]RejectionInfo(nil), r.infos...)
+			r.mu.Unlock()
+			return infos
+		}
+		r.mu.Unlock()
+	}
+	t.Fatalf("timed out waiting for %d rejections", n)
+	return nil
+}
+
+// sendRequest writes raw to a new connection to addr and waits for the
+// listener to answer and close it.
+func sendRequest(t *testing.T, addr net.Addr, raw string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	bufio.NewReader(conn).ReadString(0)
+}
+
+func TestOnRejected(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := new(rejectionRecorder)
+	recorder.jsonl = JSONLinesRejections(&recorder.lines)
+	l, err := NewListener(inner, &Config{Host: "a.example", Path: "/p"}, OnRejected(recorder.hook))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	tests := []struct {
+		request string
+		want    RejectionInfo
+	}{
+		{
+			"GET /x HTTP/1.1\r\nHost: a.example\r\nConnection: close\r\n\r\n",
+			RejectionInfo{Reason: RejectPath, Host: "a.example", Path: "/x"},
+		},
+		{
+			"GET /p HTTP/1.1\r\nHost: b.example:8080\r\nConnection: close\r\n\r\n",
+			RejectionInfo{Reason: RejectHost, Host: "b.example:8080", Path: "/p"},
+		},
+		{
+			"GET /p HTTP/1.1\r\nHost: a.example\r\nConnection: close\r\n\r\n",
+			RejectionInfo{Reason: RejectNotUpgrade, Host: "a.example", Path: "/p"},
+		},
+		{
+			"garbage\r\n\r\n",
+			RejectionInfo{Reason: RejectMalformed},
+		},
+	}
+	start := time.Now()
+	for _, test := range tests {
+		sendRequest(t, inner.Addr(), test.request)
+	}
+	infos := recorder.wait(t, len(tests))
+	for i, test := range tests {
+		got := infos[i]
+		if got.Time.Before(start) || got.Time.After(time.Now()) {
+			t.Errorf("%s: time %v out of range", test.want.Reason, got.Time)
+		}
+		got.Time = time.Time{}
+		test.want.Source = "127.0.0.1"
+		if got != test.want {
+			t.Errorf("got %+v, want %+v", got, test.want)
+		}
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	decoder := json.NewDecoder(&recorder.lines)
+	for i := range tests {
+		var line RejectionInfo
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Reason != infos[i].Reason || line.Source != infos[i].Source || !line.Time.Equal(infos[i].Time) {
+			t.Errorf("line %d: got %+v, want %+v", i, line, infos[i])
+		}
+	}
+}
+
+func TestRejectionsDropped(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	called := make(chan struct{}, 1)
+	l, err := NewListener(inner, &Config{Path: "/p"}, OnRejected(func(RejectionInfo) {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+		<-block
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	defer close(block)
+
+	// the first rejection occupies the hook, the next rejectionQueueSize wait
+	// for it and the rest are dropped
+	const extra = 10
+	sendRequest(t, inner.Addr(), "GET /x HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	<-called
+	for i := 0; i < rejectionQueueSize+extra; i++ {
+		sendRequest(t, inner.Addr(), "GET /x HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	}
+	if dropped := RejectionsDropped(l); dropped != extra {
+		t.Errorf("dropped %d rejections, want %d", dropped, extra)
+	}
+	if dropped := RejectionsDropped(inner); dropped != 0 {
+		t.Errorf("dropped %d rejections on a plain listener", dropped)
+	}
+}
+
+// pipeListener hands out the server ends of net.Pipe connections made by
+// dial.
+type pipeListener struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+const upgradeRequestText = "GET /p HTTP/1.1\r\nHost: a.example\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+
+func TestNewListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipe := newPipeListener()
+	for _, test := range []struct {
+		name  string
+		inner net.Listener
+		dial  func() (net.Conn, error)
+	}{
+		{"tcp", tcp, func() (net.Conn, error) { return net.Dial("tcp", tcp.Addr().String()) }},
+		{"pipe", pipe, func() (net.Conn, error) { return pipe.dial(), nil }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := NewListener(test.inner, &Config{Host: "a.example", Path: "/p"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				if conn, err := l.Accept(); err == nil {
+					accepted <- conn
+				}
+			}()
+
+			client, err := test.dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			// early data arrives in the same write as the request
+			go client.Write([]byte(upgradeRequestText + "early"))
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %s", resp.Status)
+			}
+
+			var server net.Conn
+			select {
+			case server = <-accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Accept did not return the upgraded connection")
+			}
+			defer server.Close()
+			b := make([]byte, len("early"))
+			if _, err := io.ReadFull(server, b); err != nil || string(b) != "early" {
+				t.Errorf("early data %q, %v", b, err)
+			}
+			go client.Write([]byte("later"))
+			if _, err := io.ReadFull(server, b); err != nil || string(b) != "later" {
+				t.Errorf("read %q, %v", b, err)
+			}
+		})
+	}
+}
+
+// upgradeTo connects to addr and completes the upgrade, returning the client
+// end of the tunnel.
+func upgradeTo(t *testing.T, addr net.Addr) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(upgradeRequestText)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %s", resp.Status)
+	}
+	return conn, reader
+}
+
+func TestServe(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken := make(chan net.Conn, 1)
+	handler := func(conn net.Conn) {
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		switch string(b) {
+		case "echo":
+			conn.Write(b)
+		case "keep":
+			TakeOver(conn)
+			taken <- conn
+		}
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(inner, &Config{Host: "a.example", Path: "/p"}, handler)
+	}()
+
+	// the handler returning closes the conn
+	conn, reader := upgradeTo(t, inner.Addr())
+	conn.Write([]byte("echo"))
+	if b, err := io.ReadAll(reader); err != nil || string(b) != "echo" {
+		t.Errorf("read %q, %v; want the echo, then EOF", b, err)
+	}
+
+	// unless TakeOver was called
+	conn, reader = upgradeTo(t, inner.Addr())
+	conn.Write([]byte("keep"))
+	kept := <-taken
+	if _, err := kept.Write([]byte("still open")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len("still open"))
+	if _, err := io.ReadFull(reader, b); err != nil || string(b) != "still open" {
+		t.Errorf("read %q, %v", b, err)
+	}
+	kept.Close()
+
+	inner.Close()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("Serve returned nil once its listener was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return once its listener was closed")
+	}
+}
+
+// connectListener starts a listener for /p on a.example and connects to it,
+// returning the client end and where the listener delivers the first
+// connection it accepts.
+func connectListener(t *testing.T) (net.Conn, <-chan net.Conn) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewListener(inner, &Config{Host: "a.example", Path: "/p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, accepted
+}
+
+func TestKeepAliveRejections(t *testing.T) {
+	conn, accepted := connectListener(t)
+	reader := bufio.NewReader(conn)
+	for _, request := range []string{
+		"GET / HTTP/1.1\r\nHost: a.example\r\n\r\n",
+		"GET /favicon.ico HTTP/1.1\r\nHost: a.example\r\n\r\n",
+		upgradeRequestText,
+	} {
+		if _, err := conn.Write([]byte(request)); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if request != upgradeRequestText {
+			if resp.StatusCode != http.StatusNotFound || resp.Close {
+				t.Errorf("status %s, close %v; want a kept-alive 404", resp.Status, resp.Close)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("status %s", resp.Status)
+		}
+	}
+	select {
+	case server := <-accepted:
+		server.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept did not return the upgraded connection")
+	}
+}
+
+func TestRejectedRequestBody(t *testing.T) {
+	const header = "POST / HTTP/1.1\r\nHost: a.example\r\n"
+	chunk := strings.Repeat("a", maxRequestBodyBytes+100)
+	for _, test := range []struct {
+		name    string
+		request string
+		status  int
+	}{
+		{"oversized content length", header + "Content-Length: " + strconv.Itoa(maxRequestBodyBytes+1) + "\r\n\r\n", http.StatusRequestEntityTooLarge},
+		{"oversized chunked", header + "Transfer-Encoding: chunked\r\n\r\n" + strconv.FormatInt(int64(len(chunk)), 16) + "\r\n" + chunk + "\r\n0\r\n\r\n", http.StatusRequestEntityTooLarge},
+		{"just under the limit", header + "Content-Length: " + strconv.Itoa(maxRequestBodyBytes-1) + "\r\n\r\n" + chunk[:maxRequestBodyBytes-1], http.StatusNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, accepted := connectListener(t)
+			// the listener may stop reading an oversized body midway
+			go conn.Write([]byte(test.request))
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %s, want %d", resp.Status, test.status)
+			}
+			if test.status == http.StatusRequestEntityTooLarge {
+				if !resp.Close {
+					t.Error("413 keeps the connection")
+				}
+				return
+			}
+			// the body was skipped, so the next request is read in full
+			conn.Write([]byte(upgradeRequestText))
+			if resp, err := http.ReadResponse(reader, nil); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("upgrade after the body: %v, %v", resp, err)
+			}
+			(<-accepted).Close()
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package httpupgrade
+
+import (
+	"context"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"github.com/xtls/xray-core/transport/internet/tls"
+)
+
+// dialOptions collects what DialOptions set before DialWithOptions turns them
+// into stream settings.
+type dialOptions struct {
+	config  *Config
+	tls     *tls.Config
+	timeout time.Duration
+}
+
+// DialOption configures a dial made through DialWithOptions.
+type DialOption func(*dialOptions)
+
+// WithTLS wraps the connection in TLS built from config.
+func WithTLS(config *tls.Config) DialOption {
+	return func(o *dialOptions) {
+		o.tls = config
+	}
+}
+
+// WithHost sets the Host header of the upgrade request.
+func WithHost(host string) DialOption {
+	return func(o *dialOptions) {
+		o.config.Host = host
+	}
+}
+
+// WithPath sets the path of the upgrade request.
+func WithPath(path string) DialOption {
+	return func(o *dialOptions) {
+		o.config.Path = path
+	}
+}
+
+// WithHeader sets the header key of the upgrade request to value, replacing
+// what an earlier WithHeader set for the same key. Keys are sent as written.
+func WithHeader(key, value string) DialOption {
+	return func(o *dialOptions) {
+		if o.config.Header == nil {
+			o.config.Header = make(map[string]string)
+		}
+		o.config.Header[key] = value
+	}
+}
+
+// WithEarlyData sets Ed, so that the dial returns without waiting for the
+// server's response and the first write goes out alongside the request.
+func WithEarlyData(ed uint32) DialOption {
+	return func(o *dialOptions) {
+		o.config.Ed = ed
+	}
+}
+
+// WithTimeout bounds the whole dial, including the upgrade handshake when it
+// is not deferred by early data.
+func WithTimeout(timeout time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.timeout = timeout
+	}
+}
+
+// DialWithOptions dials dest with stream settings assembled from opts, for
+// embedders that don't have a MemoryStreamConfig at hand.
+func DialWithOptions(ctx context.Context, dest net.Destination, opts ...DialOption) (stat.Connection, error) {
+	o := &dialOptions{config: new(Config)}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	streamSettings := &internet.MemoryStreamConfig{
+		ProtocolName:     protocolName,
+		ProtocolSettings: o.config,
+	}
+	if o.tls != nil {
+		streamSettings.SecuritySettings = o.tls
+	}
+	return Dial(ctx, dest, streamSettings)
+}
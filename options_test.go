@@ -0,0 +1,105 @@
+package httpupgrade
+
+import (
+	"context"
+	gonet "net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet/httpupgrade/httpupgradetest"
+	"github.com/xtls/xray-core/transport/internet/tls"
+)
+
+// dialWithOptions dials a FaultyServer running steps with opts and returns
+// the request it received, nil if none arrived.
+func dialWithOptions(t *testing.T, steps []httpupgradetest.Step, opts ...DialOption) (net.Conn, *http.Request, error) {
+	t.Helper()
+	requests := make(chan *http.Request, 1)
+	record := func(c *httpupgradetest.Conn) error {
+		requests <- c.Request
+		return nil
+	}
+	s, err := httpupgradetest.NewFaultyServer(append([]httpupgradetest.Step{record}, steps...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	addr := s.Addr().(*gonet.TCPAddr)
+	dest := net.TCPDestination(net.IPAddress(addr.IP), net.Port(addr.Port))
+	conn, err := DialWithOptions(context.Background(), dest, opts...)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	select {
+	case req := <-requests:
+		return conn, req, err
+	case <-time.After(time.Second):
+		return conn, nil, err
+	}
+}
+
+func TestDialWithOptions(t *testing.T) {
+	_, req, err := dialWithOptions(t, []httpupgradetest.Step{httpupgradetest.Upgrade()},
+		WithHost("cdn.example.com"),
+		WithPath("/tunnel?a=1"),
+		WithHeader("X-Token", "old"),
+		WithHeader("X-Token", "new"),
+		WithHeader("x-token", "lower"),
+		WithTimeout(5*time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req == nil {
+		t.Fatal("no request received")
+	}
+	if req.Host != "cdn.example.com" || req.RequestURI != "/tunnel?a=1" {
+		t.Errorf("request for %s%s", req.Host, req.RequestURI)
+	}
+	// a later WithHeader replaces an earlier one for the same key as written
+	if got := req.Header.Values("X-Token"); len(got) != 2 || got[0] != "new" || got[1] != "lower" {
+		t.Errorf("X-Token %q", got)
+	}
+}
+
+func TestDialWithOptionsEarlyData(t *testing.T) {
+	const delay = 500 * time.Millisecond
+	start := time.Now()
+	conn, _, err := dialWithOptions(t, []httpupgradetest.Step{httpupgradetest.Delay(delay), httpupgradetest.Upgrade(), httpupgradetest.Raw([]byte("x"))},
+		WithPath("/tunnel"),
+		WithEarlyData(2048),
+		WithTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("returned after %v, before the response was due", elapsed)
+	}
+	// the timeout bounds the dial only, not the deferred handshake
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Errorf("Read: %v", err)
+	}
+}
+
+func TestDialWithOptionsTimeout(t *testing.T) {
+	start := time.Now()
+	_, _, err := dialWithOptions(t, []httpupgradetest.Step{httpupgradetest.Silence()},
+		WithHost("cdn.example.com"),
+		WithTimeout(100*time.Millisecond),
+	)
+	requireStage(t, err, StageResponse, "")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("returned after %v", elapsed)
+	}
+}
+
+func TestDialWithOptionsTLS(t *testing.T) {
+	_, _, err := dialWithOptions(t, []httpupgradetest.Step{httpupgradetest.Upgrade()},
+		WithTLS(&tls.Config{AllowInsecure: true}),
+		WithHost("cdn.example.com"),
+	)
+	requireStage(t, err, StageTLS, "plaintext")
+}
@@ -0,0 +1,102 @@
+package httpupgrade
+
+import (
+	"context"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+)
+
+// Stage identifies a step of the dial pipeline.
+type Stage string
+
+const (
+	StageConnect  Stage = "connect"
+	StageTLS      Stage = "tls"
+	StageRequest  Stage = "request"
+	StageResponse Stage = "response"
+	StageValidate Stage = "validate"
+)
+
+// ProbeResult holds how long each stage of a probe took. Stages that were not
+// reached are left zero, and so is TLS when no TLS is configured.
+type ProbeResult struct {
+	Connect  time.Duration
+	TLS      time.Duration
+	Request  time.Duration
+	Response time.Duration
+	// Failed is the stage that failed, empty on success.
+	Failed Stage
+}
+
+// Probe dials dest, completes the upgrade handshake and closes the connection
+// straight away without sending any payload. It is meant for health checkers
+// that want to measure the upgrade itself rather than a bare TCP connect.
+func Probe(ctx context.Context, streamSettings *internet.MemoryStreamConfig, dest net.Destination) (ProbeResult, error) {
+	var report DiagnoseReport
+	err := probe(ctx, streamSettings, dest, dest, &report)
+	return report.ProbeResult, err
+}
+
+// probe runs the stages of a dial against dest, connecting to connectTo, and
+// records into report what each of them took and revealed, stopping at the
+// first failure.
+func probe(ctx context.Context, streamSettings *internet.MemoryStreamConfig, dest, connectTo net.Destination, report *DiagnoseReport) error {
+	transportConfiguration := streamSettings.ProtocolSettings.(*Config)
+	info := newDialInfo(dest, schemeFor(streamSettings), transportConfiguration)
+
+	start := time.Now()
+	pconn, err := dialSystem(ctx, connectTo, streamSettings.SocketSettings)
+	report.Connect = time.Since(start)
+	if err != nil {
+		report.Failed = StageConnect
+		return info.wrap(StageConnect, err)
+	}
+	defer pconn.Close()
+	release := bindContext(ctx, pconn)
+	defer release()
+
+	start = time.Now()
+	conn, scheme, err := clientTLS(ctx, pconn, streamSettings, info)
+	if scheme != "http" {
+		report.TLS = time.Since(start)
+	}
+	if err != nil {
+		report.Failed = StageTLS
+		return err
+	}
+	report.recordTLS(conn)
+
+	start = time.Now()
+	r, err := buildRequest(scheme, dest.NetAddr(), transportConfiguration)
+	if err == nil {
+		err = r.writeTo(conn)
+		tracerFromContext(ctx).wroteRequest(err)
+	}
+	report.Request = time.Since(start)
+	if err != nil {
+		report.Failed = StageRequest
+		return info.wrap(StageRequest, err)
+	}
+
+	start = time.Now()
+	connRF := &ConnRF{
+		Conn:   conn,
+		Req:    r.req,
+		First:  true,
+		tracer: tracerFromContext(ctx),
+		info:   info,
+	}
+	_, err = connRF.Read([]byte{})
+	report.Response = time.Since(start)
+	if connRF.resp != nil {
+		report.Status = connRF.resp.Status
+		report.ResponseHeader = connRF.resp.Header
+	}
+	if err != nil {
+		report.Failed = stageOf(err, StageResponse)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package httpupgrade
+
+import (
+	"context"
+	gonet "net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/httpupgrade/httpupgradetest"
+)
+
+// slowDialer connects through the default system dialer after a delay.
+type slowDialer struct {
+	internet.DefaultSystemDialer
+	delay time.Duration
+}
+
+func (d *slowDialer) Dial(ctx context.Context, source net.Address, dest net.Destination, sockopt *internet.SocketConfig) (net.Conn, error) {
+	time.Sleep(d.delay)
+	return d.DefaultSystemDialer.Dial(ctx, source, dest, sockopt)
+}
+
+// probeFaulty probes a FaultyServer running steps.
+func probeFaulty(t *testing.T, ctx context.Context, steps ...httpupgradetest.Step) (ProbeResult, error) {
+	t.Helper()
+	s, err := httpupgradetest.NewFaultyServer(steps...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	addr := s.Addr().(*gonet.TCPAddr)
+	dest := net.TCPDestination(net.IPAddress(addr.IP), net.Port(addr.Port))
+	return Probe(ctx, &internet.MemoryStreamConfig{ProtocolSettings: &Config{}}, dest)
+}
+
+func TestProbeStageDurations(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	internet.UseAlternativeSystemDialer(&slowDialer{delay: delay})
+	t.Cleanup(func() { internet.UseAlternativeSystemDialer(nil) })
+
+	result, err := probeFaulty(t, context.Background(), httpupgradetest.Delay(2*delay), httpupgradetest.Upgrade())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed != "" {
+		t.Errorf("failed at %q", result.Failed)
+	}
+	if result.Connect < delay {
+		t.Errorf("connect took %v, want at least %v", result.Connect, delay)
+	}
+	if result.Response < 2*delay {
+		t.Errorf("response took %v, want at least %v", result.Response, 2*delay)
+	}
+	if result.TLS != 0 {
+		t.Errorf("TLS took %v without TLS configured", result.TLS)
+	}
+}
+
+func TestProbeFailures(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	result, err := probeFaulty(t, ctx, httpupgradetest.Silence())
+	requireStage(t, err, StageResponse, "")
+	if result.Failed != StageResponse || result.Response < timeout/2 {
+		t.Errorf("result %+v", result)
+	}
+
+	result, err = probeFaulty(t, context.Background(), httpupgradetest.Delay(timeout), httpupgradetest.Respond(http.StatusNotFound, nil, ""))
+	requireStage(t, err, StageValidate, "404")
+	if result.Failed != StageValidate || result.Response < timeout {
+		t.Errorf("result %+v", result)
+	}
+}
@@ -0,0 +1,53 @@
+package httpupgrade
+
+import (
+	"context"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+)
+
+// Resolver looks up the addresses of a domain.
+type Resolver interface {
+	LookupIP(ctx context.Context, domain string) ([]net.IP, error)
+}
+
+type resolverKey struct{}
+
+// ContextWithResolver returns a copy of ctx that makes dials resolve domain
+// destinations through resolver before connecting, instead of leaving the
+// resolution to DialSystem. The TLS server name and Host header still derive
+// from the domain.
+func ContextWithResolver(ctx context.Context, resolver Resolver) context.Context {
+	return context.WithValue(ctx, resolverKey{}, resolver)
+}
+
+func resolverFromContext(ctx context.Context) Resolver {
+	resolver, _ := ctx.Value(resolverKey{}).(Resolver)
+	return resolver
+}
+
+// dialSystem connects to dest, resolving it first through the resolver in
+// ctx if there is one and dest is a domain, and reports both to the tracer in
+// ctx.
+func dialSystem(ctx context.Context, dest net.Destination, sockopt *internet.SocketConfig) (net.Conn, error) {
+	tracer := tracerFromContext(ctx)
+	if resolver := resolverFromContext(ctx); resolver != nil && dest.Address.Family().IsDomain() {
+		tracer.dnsStart(dest.Address.Domain())
+		ips, err := resolver.LookupIP(ctx, dest.Address.Domain())
+		tracer.dnsDone(ips, err)
+		if err != nil {
+			return nil, errors.New("failed to resolve ", dest.Address).Base(err)
+		}
+		if len(ips) == 0 {
+			return nil, errors.New("no address for ", dest.Address)
+		}
+		errors.LogDebug(ctx, "resolved ", dest.Address, " to ", ips[0])
+		dest.Address = net.IPAddress(ips[0])
+	}
+	tracer.connectStart(dest)
+	conn, err := internet.DialSystem(ctx, dest, sockopt)
+	tracer.connectDone(dest, err)
+	return conn, err
+}
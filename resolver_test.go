@@ -0,0 +1,68 @@
+package httpupgrade
+
+import (
+	"context"
+	goerrors "errors"
+	gonet "net"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/httpupgrade/httpupgradetest"
+)
+
+func TestDialThroughResolver(t *testing.T) {
+	hosts := make(chan string, 1)
+	record := func(c *httpupgradetest.Conn) error {
+		hosts <- c.Request.Host
+		return nil
+	}
+	s, err := httpupgradetest.NewFaultyServer(record, httpupgradetest.Upgrade())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.Addr().(*gonet.TCPAddr)
+
+	resolver := &countingResolver{ips: []net.IP{addr.IP}}
+	ctx := ContextWithResolver(context.Background(), resolver)
+	dest := net.TCPDestination(net.DomainAddress("tunnel.example"), net.Port(addr.Port))
+	conn, err := Dial(ctx, dest, &internet.MemoryStreamConfig{ProtocolSettings: &Config{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := resolver.lookups.Load(); n != 1 {
+		t.Errorf("resolved %d times, want once", n)
+	}
+	// the request still names the domain, not what it resolved to
+	if host := <-hosts; host != dest.NetAddr() {
+		t.Errorf("Host %q, want %q", host, dest.NetAddr())
+	}
+}
+
+func TestDialResolverFailure(t *testing.T) {
+	lookupErr := goerrors.New("no such host")
+	for _, resolver := range []*countingResolver{{err: lookupErr}, {}} {
+		ctx := ContextWithResolver(context.Background(), resolver)
+		dest := net.TCPDestination(net.DomainAddress("tunnel.example"), 443)
+		_, err := Dial(ctx, dest, &internet.MemoryStreamConfig{ProtocolSettings: &Config{}})
+		requireStage(t, err, StageConnect, "tunnel.example")
+		if resolver.err != nil && !goerrors.Is(err, lookupErr) {
+			t.Errorf("got %v, want the lookup error", err)
+		}
+	}
+}
+
+func TestDialResolverSkipsIPs(t *testing.T) {
+	resolver := &countingResolver{}
+	ctx := ContextWithResolver(context.Background(), resolver)
+	conn, err := dialFaulty(t, ctx, &Config{}, httpupgradetest.Upgrade())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := resolver.lookups.Load(); n != 0 {
+		t.Errorf("resolved %d times for an IP destination", n)
+	}
+}
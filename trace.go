@@ -0,0 +1,95 @@
+package httpupgrade
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/xtls/xray-core/common/net"
+)
+
+// Tracer is a set of hooks called at the stages of a dial, in the spirit of
+// net/http/httptrace.ClientTrace. Any field may be nil, in which case the
+// event is not reported. Hooks are called synchronously by the goroutine
+// performing the stage. GotResponse is called from the first Read when early
+// data defers the handshake.
+type Tracer struct {
+	// DNSStart and DNSDone bracket resolution through a Resolver set by
+	// ContextWithResolver, and Diagnose's own. Resolution left to
+	// DialSystem is not reported.
+	DNSStart func(domain string)
+	DNSDone  func(ips []net.IP, err error)
+
+	ConnectStart func(dest net.Destination)
+	ConnectDone  func(dest net.Destination, err error)
+
+	TLSHandshakeStart func()
+	TLSHandshakeDone  func(err error)
+
+	WroteRequest func(err error)
+	// GotResponse reports the server's response to the upgrade request, resp
+	// being nil if none could be parsed.
+	GotResponse func(resp *http.Response, err error)
+}
+
+type tracerKey struct{}
+
+// ContextWithTracer returns a copy of ctx that makes dials report their
+// stages to tracer.
+func ContextWithTracer(ctx context.Context, tracer *Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+// tracerFromContext returns the Tracer in ctx, or nil. The methods below may
+// be called on a nil Tracer.
+func tracerFromContext(ctx context.Context) *Tracer {
+	tracer, _ := ctx.Value(tracerKey{}).(*Tracer)
+	return tracer
+}
+
+func (t *Tracer) dnsStart(domain string) {
+	if t != nil && t.DNSStart != nil {
+		t.DNSStart(domain)
+	}
+}
+
+func (t *Tracer) dnsDone(ips []net.IP, err error) {
+	if t != nil && t.DNSDone != nil {
+		t.DNSDone(ips, err)
+	}
+}
+
+func (t *Tracer) connectStart(dest net.Destination) {
+	if t != nil && t.ConnectStart != nil {
+		t.ConnectStart(dest)
+	}
+}
+
+func (t *Tracer) connectDone(dest net.Destination, err error) {
+	if t != nil && t.ConnectDone != nil {
+		t.ConnectDone(dest, err)
+	}
+}
+
+func (t *Tracer) tlsHandshakeStart() {
+	if t != nil && t.TLSHandshakeStart != nil {
+		t.TLSHandshakeStart()
+	}
+}
+
+func (t *Tracer) tlsHandshakeDone(err error) {
+	if t != nil && t.TLSHandshakeDone != nil {
+		t.TLSHandshakeDone(err)
+	}
+}
+
+func (t *Tracer) wroteRequest(err error) {
+	if t != nil && t.WroteRequest != nil {
+		t.WroteRequest(err)
+	}
+}
+
+func (t *Tracer) gotResponse(resp *http.Response, err error) {
+	if t != nil && t.GotResponse != nil {
+		t.GotResponse(resp, err)
+	}
+}
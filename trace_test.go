@@ -0,0 +1,138 @@
+package httpupgrade
+
+import (
+	"context"
+	goerrors "errors"
+	gonet "net"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/httpupgrade/httpupgradetest"
+	"github.com/xtls/xray-core/transport/internet/tls"
+)
+
+// traceRecorder returns a Tracer setting every hook, and a function
+// returning the events recorded so far, each suffixed with whether it
+// carried an error.
+func traceRecorder() (*Tracer, func() []string) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			event += " error"
+		}
+		events = append(events, event)
+	}
+	tracer := &Tracer{
+		DNSStart:          func(string) { record("DNSStart", nil) },
+		DNSDone:           func(_ []net.IP, err error) { record("DNSDone", err) },
+		ConnectStart:      func(net.Destination) { record("ConnectStart", nil) },
+		ConnectDone:       func(_ net.Destination, err error) { record("ConnectDone", err) },
+		TLSHandshakeStart: func() { record("TLSHandshakeStart", nil) },
+		TLSHandshakeDone:  func(err error) { record("TLSHandshakeDone", err) },
+		WroteRequest:      func(err error) { record("WroteRequest", err) },
+		GotResponse: func(resp *http.Response, err error) {
+			if resp != nil {
+				record("GotResponse "+resp.Status[:3], err)
+			} else {
+				record("GotResponse", err)
+			}
+		},
+	}
+	return tracer, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), events...)
+	}
+}
+
+func TestTracerOrder(t *testing.T) {
+	// a port nothing listens on
+	l, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := net.Port(l.Addr().(*gonet.TCPAddr).Port)
+	l.Close()
+
+	connected := []string{"DNSStart", "DNSDone", "ConnectStart", "ConnectDone"}
+	for _, test := range []struct {
+		name    string
+		lookErr error
+		closed  bool
+		tls     bool
+		// cancel cancels the dial once connected
+		cancel bool
+		steps  []httpupgradetest.Step
+		want   []string
+	}{
+		{"success", nil, false, false, false, []httpupgradetest.Step{httpupgradetest.Upgrade()},
+			append(connected, "WroteRequest", "GotResponse 101")},
+		{"dns", goerrors.New("no such host"), false, false, false, nil,
+			[]string{"DNSStart", "DNSDone error"}},
+		{"connect", nil, true, false, false, nil,
+			[]string{"DNSStart", "DNSDone", "ConnectStart", "ConnectDone error"}},
+		{"tls", nil, false, true, false, []httpupgradetest.Step{httpupgradetest.Upgrade()},
+			append(connected, "TLSHandshakeStart", "TLSHandshakeDone error")},
+		{"request", nil, false, false, true, []httpupgradetest.Step{httpupgradetest.Silence()},
+			append(connected, "WroteRequest error")},
+		{"response", nil, false, false, false, nil,
+			append(connected, "WroteRequest", "GotResponse error")},
+		{"validate", nil, false, false, false, []httpupgradetest.Step{httpupgradetest.Respond(http.StatusNotFound, nil, "")},
+			append(connected, "WroteRequest", "GotResponse 404 error")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := httpupgradetest.NewFaultyServer(test.steps...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			addr := s.Addr().(*gonet.TCPAddr)
+			port := net.Port(addr.Port)
+			if test.closed {
+				port = closedPort
+			}
+
+			tracer, events := traceRecorder()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancel {
+				connectDone := tracer.ConnectDone
+				tracer.ConnectDone = func(dest net.Destination, err error) {
+					connectDone(dest, err)
+					cancel()
+				}
+			}
+			resolver := &countingResolver{ips: []net.IP{addr.IP}, err: test.lookErr}
+			ctx = ContextWithResolver(ContextWithTracer(ctx, tracer), resolver)
+			streamSettings := &internet.MemoryStreamConfig{ProtocolSettings: &Config{}}
+			if test.tls {
+				streamSettings.SecuritySettings = &tls.Config{AllowInsecure: true}
+			}
+			dest := net.TCPDestination(net.DomainAddress("example.com"), port)
+			conn, err := Dial(ctx, dest, streamSettings)
+			if conn != nil {
+				conn.Close()
+			}
+			if (err == nil) != (test.name == "success") {
+				t.Errorf("Dial: %v", err)
+			}
+			if got := events(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("events %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNilTracerHooks(t *testing.T) {
+	ctx := ContextWithTracer(context.Background(), &Tracer{})
+	if _, err := dialFaulty(t, ctx, &Config{}, httpupgradetest.Upgrade()); err != nil {
+		t.Fatal(err)
+	}
+}